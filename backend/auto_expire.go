@@ -0,0 +1,75 @@
+package backend
+
+import (
+	"github.com/jinzhu/gorm"
+)
+
+// AutoExpireInterface describes the behavior of accessing auto expire settings
+type AutoExpireInterface interface {
+	SetAutoExpire(a *AutoExpire) error
+	DeleteAutoExpire(userID, channelID string) error
+	GetAutoExpire(userID, channelID string) (*AutoExpire, error)
+	GetAutoExpiresByUserID(userID string) ([]AutoExpire, error)
+}
+
+// AutoExpire opts a user in to having everything they post in a channel
+// deleted after a delay
+type AutoExpire struct {
+	gorm.Model
+	UserID string `gorm:"unique_index:idx_auto_expire_user_channel"`
+	TeamID string
+	// EnterpriseID is set for workspaces of an Enterprise Grid org
+	EnterpriseID string
+	ChannelID    string `gorm:"unique_index:idx_auto_expire_user_channel"`
+	TTLSeconds   int
+}
+
+// SetAutoExpire creates or updates the auto expire setting of a user in a channel
+func (b *Backend) SetAutoExpire(a *AutoExpire) error {
+	var existing AutoExpire
+	result := b.db.Unscoped().Where("user_id = ? AND channel_id = ?", a.UserID, a.ChannelID).First(&existing)
+	if result.Error != nil && !gorm.IsRecordNotFoundError(result.Error) {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	if result.Error == nil {
+		a.ID = existing.ID
+		a.CreatedAt = existing.CreatedAt
+	}
+	if result := b.db.Unscoped().Save(a); result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
+
+// DeleteAutoExpire turns auto expire off for a user in a channel
+func (b *Backend) DeleteAutoExpire(userID, channelID string) error {
+	result := b.db.Unscoped().Where("user_id = ? AND channel_id = ?", userID, channelID).Delete(&AutoExpire{})
+	if result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetAutoExpire gets the auto expire setting of a user in a channel
+func (b *Backend) GetAutoExpire(userID, channelID string) (*AutoExpire, error) {
+	var a AutoExpire
+	if result := b.db.Where("user_id = ? AND channel_id = ?", userID, channelID).First(&a); result.Error != nil {
+		if gorm.IsRecordNotFoundError(result.Error) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return &a, nil
+}
+
+// GetAutoExpiresByUserID gets all auto expire settings of a user
+func (b *Backend) GetAutoExpiresByUserID(userID string) ([]AutoExpire, error) {
+	var settings []AutoExpire
+	if result := b.db.Where("user_id = ?", userID).Order("id").Find(&settings); result.Error != nil {
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return settings, nil
+}
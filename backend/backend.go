@@ -10,6 +10,8 @@ import (
 // Backend stores all the Database internals for data access
 type Backend struct {
 	db *gorm.DB
+	// keys encrypts access tokens at rest once UseKeyring is called
+	keys *Keyring
 }
 
 // InitDatabase takes a connection string URL to pass into the Database
@@ -24,10 +26,7 @@ func InitDatabase(url *url.URL) (*Backend, error) {
 	// SetMaxOpenConns sets the maximum number of open connections to the database.
 	db.DB().SetMaxOpenConns(20)
 
-	if !db.HasTable(&TokenData{}) {
-		db.CreateTable(&TokenData{})
-	}
-
+	// the schema is owned by the migrations package
 	return &Backend{
 		db: db,
 	}, nil
@@ -1,6 +1,41 @@
 package backend
 
+import (
+	"fmt"
+	"net/url"
+)
+
 // Database interface describes the persistence functionality of the application
 type Database interface {
 	TokenDataInterface
+	RetentionPolicyInterface
+	AutoExpireInterface
+	ProcessedEventInterface
+	TaskRunInterface
+	PendingCleanupInterface
+
+	// UseKeyring turns on encryption of access tokens and re-encrypts the
+	// stored ones, returning how many it re-encrypted
+	UseKeyring(k *Keyring) (int, error)
+	Close()
+}
+
+var (
+	_ Database = (*Backend)(nil)
+	_ Database = (*Memory)(nil)
+)
+
+// Open connects to the Database selected by the scheme of the URL:
+// postgres:// for Postgres, sqlite: for a SQLite file and memory: for an
+// in-memory Database
+func Open(u *url.URL) (Database, error) {
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		return InitDatabase(u)
+	case "sqlite", "sqlite3":
+		return InitSQLite(u)
+	case "memory":
+		return NewMemory(), nil
+	}
+	return nil, fmt.Errorf("unsupported database scheme %q", u.Scheme)
 }
@@ -0,0 +1,378 @@
+package backend
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Memory is a Database kept in process memory. Nothing survives a restart,
+// which makes it suited to tests and local development.
+type Memory struct {
+	mu       sync.Mutex
+	nextID   uint
+	tokens   map[uint]TokenData
+	policies map[uint]RetentionPolicy
+	expires  map[uint]AutoExpire
+	events   map[string]time.Time
+	runs     map[string]time.Time
+	pending  map[string]PendingCleanup
+}
+
+// NewMemory creates an empty in-memory Database
+func NewMemory() *Memory {
+	return &Memory{
+		tokens:   make(map[uint]TokenData),
+		policies: make(map[uint]RetentionPolicy),
+		expires:  make(map[uint]AutoExpire),
+		events:   make(map[string]time.Time),
+		runs:     make(map[string]time.Time),
+		pending:  make(map[string]PendingCleanup),
+	}
+}
+
+// Close is a no-op
+func (m *Memory) Close() {}
+
+// UseKeyring is a no-op, tokens held in memory are never written out
+func (m *Memory) UseKeyring(k *Keyring) (int, error) {
+	return 0, nil
+}
+
+func (m *Memory) id() uint {
+	m.nextID++
+	return m.nextID
+}
+
+// CreateTokenData adds token data
+func (m *Memory) CreateTokenData(t *TokenData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, existing := range m.tokens {
+		if existing.TeamID == t.TeamID && existing.UserID == t.UserID {
+			return ErrDatabaseGeneral("duplicate token for team " + t.TeamID + " and user " + t.UserID)
+		}
+	}
+	now := time.Now()
+	t.ID = m.id()
+	t.CreatedAt = now
+	t.UpdatedAt = now
+	m.tokens[t.ID] = *t
+	return nil
+}
+
+// UpdateTokenData updates the non-zero fields of token data, like gorm does
+func (m *Memory) UpdateTokenData(t *TokenData) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	existing, ok := m.tokens[t.ID]
+	if !ok {
+		return ErrRecordNotFound
+	}
+	if t.OAuthResponse.AccessToken != "" {
+		existing.OAuthResponse = t.OAuthResponse
+	}
+	if t.TeamDomain != "" {
+		existing.TeamDomain = t.TeamDomain
+	}
+	if t.EnterpriseID != "" {
+		existing.EnterpriseID = t.EnterpriseID
+	}
+	if t.LastUsedAt != nil {
+		existing.LastUsedAt = t.LastUsedAt
+	}
+	existing.UpdatedAt = time.Now()
+	m.tokens[t.ID] = existing
+	return nil
+}
+
+// GetTokenData gets the token a user installed in a workspace, falling back
+// to one installed in another workspace of the same Enterprise Grid org
+func (m *Memory) GetTokenData(teamID, enterpriseID, userID string) (*TokenData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var fallback *TokenData
+	for _, t := range m.tokens {
+		t := t
+		if t.UserID != userID {
+			continue
+		}
+		if t.TeamID == teamID {
+			return &t, nil
+		}
+		if enterpriseID != "" && t.EnterpriseID == enterpriseID &&
+			(fallback == nil || t.UpdatedAt.After(fallback.UpdatedAt)) {
+			fallback = &t
+		}
+	}
+	if fallback == nil {
+		return nil, ErrRecordNotFound
+	}
+	return fallback, nil
+}
+
+// GetAllTokenData gets every stored token
+func (m *Memory) GetAllTokenData() ([]TokenData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	tokens := make([]TokenData, 0, len(m.tokens))
+	for _, t := range m.tokens {
+		tokens = append(tokens, t)
+	}
+	sort.Slice(tokens, func(i, j int) bool { return tokens[i].ID < tokens[j].ID })
+	return tokens, nil
+}
+
+// TouchTokenData records that a token was used
+func (m *Memory) TouchTokenData(id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if t, ok := m.tokens[id]; ok {
+		now := time.Now()
+		t.LastUsedAt = &now
+		m.tokens[id] = t
+	}
+	return nil
+}
+
+// DeleteTokenData purges the tokens of users of a workspace, or of every
+// user of the workspace when userIDs is empty
+func (m *Memory) DeleteTokenData(teamID string, userIDs []string) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	users := make(map[string]bool)
+	for _, u := range userIDs {
+		users[u] = true
+	}
+	var deleted int64
+	for id, t := range m.tokens {
+		if t.TeamID == teamID && (len(users) == 0 || users[t.UserID]) {
+			delete(m.tokens, id)
+			deleted++
+		}
+	}
+	return deleted, nil
+}
+
+// GetUnusedTokenData gets the tokens not used since before
+func (m *Memory) GetUnusedTokenData(before time.Time) ([]TokenData, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var tokens []TokenData
+	for _, t := range m.tokens {
+		used := t.UpdatedAt
+		if t.LastUsedAt != nil {
+			used = *t.LastUsedAt
+		}
+		if used.Before(before) {
+			tokens = append(tokens, t)
+		}
+	}
+	return tokens, nil
+}
+
+// CreateRetentionPolicy adds a retention policy
+func (m *Memory) CreateRetentionPolicy(p *RetentionPolicy) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	p.ID = m.id()
+	p.CreatedAt = now
+	p.UpdatedAt = now
+	m.policies[p.ID] = *p
+	return nil
+}
+
+// DeleteRetentionPolicy removes a retention policy owned by the user
+func (m *Memory) DeleteRetentionPolicy(userID string, id uint) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.policies[id]
+	if !ok || p.UserID != userID {
+		return ErrRecordNotFound
+	}
+	delete(m.policies, id)
+	return nil
+}
+
+// GetRetentionPoliciesByUserID gets all retention policies of a user
+func (m *Memory) GetRetentionPoliciesByUserID(userID string) ([]RetentionPolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var policies []RetentionPolicy
+	for _, p := range m.policies {
+		if p.UserID == userID {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].ID < policies[j].ID })
+	return policies, nil
+}
+
+// GetDueRetentionPolicies gets the retention policies whose next run is due
+func (m *Memory) GetDueRetentionPolicies(now time.Time) ([]RetentionPolicy, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var policies []RetentionPolicy
+	for _, p := range m.policies {
+		if !p.NextRunAt.After(now) {
+			policies = append(policies, p)
+		}
+	}
+	sort.Slice(policies, func(i, j int) bool { return policies[i].NextRunAt.Before(policies[j].NextRunAt) })
+	return policies, nil
+}
+
+// ClaimRetentionPolicy moves the next run of a due policy forward unless
+// another caller already did
+func (m *Memory) ClaimRetentionPolicy(p *RetentionPolicy, next time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	stored, ok := m.policies[p.ID]
+	if !ok || !stored.NextRunAt.Equal(p.NextRunAt) {
+		return false, nil
+	}
+	stored.NextRunAt = next
+	stored.UpdatedAt = time.Now()
+	m.policies[p.ID] = stored
+	p.NextRunAt = next
+	return true, nil
+}
+
+// SetAutoExpire creates or updates the auto expire setting of a user in a channel
+func (m *Memory) SetAutoExpire(a *AutoExpire) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	now := time.Now()
+	a.ID, a.CreatedAt = 0, now
+	for id, existing := range m.expires {
+		if existing.UserID == a.UserID && existing.ChannelID == a.ChannelID {
+			a.ID, a.CreatedAt = id, existing.CreatedAt
+		}
+	}
+	if a.ID == 0 {
+		a.ID = m.id()
+	}
+	a.UpdatedAt = now
+	m.expires[a.ID] = *a
+	return nil
+}
+
+// DeleteAutoExpire turns auto expire off for a user in a channel
+func (m *Memory) DeleteAutoExpire(userID, channelID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, a := range m.expires {
+		if a.UserID == userID && a.ChannelID == channelID {
+			delete(m.expires, id)
+			return nil
+		}
+	}
+	return ErrRecordNotFound
+}
+
+// GetAutoExpire gets the auto expire setting of a user in a channel
+func (m *Memory) GetAutoExpire(userID, channelID string) (*AutoExpire, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, a := range m.expires {
+		if a.UserID == userID && a.ChannelID == channelID {
+			return &a, nil
+		}
+	}
+	return nil, ErrRecordNotFound
+}
+
+// GetAutoExpiresByUserID gets all auto expire settings of a user
+func (m *Memory) GetAutoExpiresByUserID(userID string) ([]AutoExpire, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var settings []AutoExpire
+	for _, a := range m.expires {
+		if a.UserID == userID {
+			settings = append(settings, a)
+		}
+	}
+	sort.Slice(settings, func(i, j int) bool { return settings[i].ID < settings[j].ID })
+	return settings, nil
+}
+
+// MarkEventProcessed records an event ID, reporting false when it was
+// already recorded
+func (m *Memory) MarkEventProcessed(eventID string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.events[eventID]; ok {
+		return false, nil
+	}
+	m.events[eventID] = time.Now()
+	return true, nil
+}
+
+// UnmarkEventProcessed removes an event ID
+func (m *Memory) UnmarkEventProcessed(eventID string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.events, eventID)
+	return nil
+}
+
+// PurgeProcessedEvents removes event IDs recorded before the given time
+func (m *Memory) PurgeProcessedEvents(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for id, at := range m.events {
+		if at.Before(before) {
+			delete(m.events, id)
+		}
+	}
+	return nil
+}
+
+// ClaimTaskRun records a run of the named task at now unless one was recorded
+// after since
+func (m *Memory) ClaimTaskRun(name string, now, since time.Time) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if last, ok := m.runs[name]; ok && !last.Before(since) {
+		return false, nil
+	}
+	m.runs[name] = now
+	return true, nil
+}
+
+// SavePendingCleanup stores a cleanup awaiting confirmation
+func (m *Memory) SavePendingCleanup(p *PendingCleanup) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if p.CreatedAt.IsZero() {
+		p.CreatedAt = time.Now()
+	}
+	m.pending[p.Nonce] = *p
+	return nil
+}
+
+// TakePendingCleanup removes and returns the cleanup the user saved under
+// nonce after since
+func (m *Memory) TakePendingCleanup(nonce, userID string, since time.Time) (*PendingCleanup, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	p, ok := m.pending[nonce]
+	if !ok || p.UserID != userID || p.CreatedAt.Before(since) {
+		return nil, ErrRecordNotFound
+	}
+	delete(m.pending, nonce)
+	return &p, nil
+}
+
+// PurgePendingCleanups removes cleanups that were never confirmed
+func (m *Memory) PurgePendingCleanups(before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for nonce, p := range m.pending {
+		if p.CreatedAt.Before(before) {
+			delete(m.pending, nonce)
+		}
+	}
+	return nil
+}
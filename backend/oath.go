@@ -1,6 +1,8 @@
 package backend
 
 import (
+	"time"
+
 	"github.com/jinzhu/gorm"
 	"github.com/nlopes/slack"
 )
@@ -9,44 +11,68 @@ import (
 type TokenDataInterface interface {
 	CreateTokenData(t *TokenData) error
 	UpdateTokenData(t *TokenData) error
-	GetTokenDataByUserID(id string) (*TokenData, error)
+	GetTokenData(teamID, enterpriseID, userID string) (*TokenData, error)
+	GetAllTokenData() ([]TokenData, error)
+	TouchTokenData(id uint) error
+	DeleteTokenData(teamID string, userIDs []string) (int64, error)
+	GetUnusedTokenData(before time.Time) ([]TokenData, error)
 }
 
-// TokenData stores the OAuthResponse details from users
+// TokenData stores the OAuthResponse details from users, one record per
+// workspace a user installed the app in
 type TokenData struct {
 	gorm.Model
 	slack.OAuthResponse
+	// TeamDomain is the subdomain of the workspace the token belongs to
+	TeamDomain string
+	// EnterpriseID is set for workspaces of an Enterprise Grid org
+	EnterpriseID string `gorm:"index"`
+	// LastUsedAt is when a command or job last needed the token
+	LastUsedAt *time.Time
 }
 
 // CreateTokenData adds token data to the database
 func (b *Backend) CreateTokenData(t *TokenData) error {
-	if result := b.db.Create(t); result.Error != nil {
+	sealed, err := b.sealToken(t)
+	if err != nil {
+		return err
+	}
+	if result := b.db.Create(sealed); result.Error != nil {
 		return ErrDatabaseGeneral(result.Error.Error())
 	}
+	t.Model = sealed.Model
 	return nil
 }
 
-// GetTokenDataByUserID gets token data by the UserID
-func (b *Backend) GetTokenDataByUserID(id string) (TokenData, error) {
+// GetTokenData gets the token a user installed in a workspace. Within an
+// Enterprise Grid org, where user IDs are shared across workspaces, a token
+// installed in another workspace of the same org is used as a fallback
+func (b *Backend) GetTokenData(teamID, enterpriseID, userID string) (*TokenData, error) {
 	var t TokenData
-	oauthFilter := slack.OAuthResponse{
-		UserID: id,
-	}
-	filter := TokenData{
-		OAuthResponse: oauthFilter,
+	result := b.db.Where("team_id = ? AND user_id = ?", teamID, userID).First(&t)
+	if gorm.IsRecordNotFoundError(result.Error) && enterpriseID != "" {
+		t = TokenData{}
+		result = b.db.Where("enterprise_id = ? AND user_id = ?", enterpriseID, userID).Order("updated_at desc").First(&t)
 	}
-	if result := b.db.Where(&filter).First(&t); result.Error != nil {
+	if result.Error != nil {
 		if gorm.IsRecordNotFoundError(result.Error) {
-			return t, ErrRecordNotFound
+			return nil, ErrRecordNotFound
 		}
-		return t, ErrDatabaseGeneral(result.Error.Error())
+		return nil, ErrDatabaseGeneral(result.Error.Error())
 	}
-	return t, nil
+	if err := b.openToken(&t); err != nil {
+		return nil, err
+	}
+	return &t, nil
 }
 
 // UpdateTokenData updates token data in DB
 func (b *Backend) UpdateTokenData(t *TokenData) error {
-	if result := b.db.Model(&TokenData{}).Updates(t); result.Error != nil {
+	sealed, err := b.sealToken(t)
+	if err != nil {
+		return err
+	}
+	if result := b.db.Model(sealed).Updates(sealed); result.Error != nil {
 		if gorm.IsRecordNotFoundError(result.Error) {
 			return ErrRecordNotFound
 		}
@@ -54,3 +80,56 @@ func (b *Backend) UpdateTokenData(t *TokenData) error {
 	}
 	return nil
 }
+
+// GetAllTokenData gets every stored token
+func (b *Backend) GetAllTokenData() ([]TokenData, error) {
+	var tokens []TokenData
+	if result := b.db.Order("id").Find(&tokens); result.Error != nil {
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	for i := range tokens {
+		if err := b.openToken(&tokens[i]); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
+
+// TouchTokenData records that a token was used
+func (b *Backend) TouchTokenData(id uint) error {
+	result := b.db.Model(&TokenData{}).Where("id = ?", id).UpdateColumn("last_used_at", time.Now())
+	if result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
+
+// DeleteTokenData purges the tokens of users of a workspace, or of every
+// user of the workspace when userIDs is empty
+func (b *Backend) DeleteTokenData(teamID string, userIDs []string) (int64, error) {
+	query := b.db.Unscoped().Where("team_id = ?", teamID)
+	if len(userIDs) > 0 {
+		query = query.Where("user_id IN (?)", userIDs)
+	}
+	result := query.Delete(&TokenData{})
+	if result.Error != nil {
+		return 0, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return result.RowsAffected, nil
+}
+
+// GetUnusedTokenData gets the tokens not used since before. Tokens stored
+// before usage was tracked count from their last update.
+func (b *Backend) GetUnusedTokenData(before time.Time) ([]TokenData, error) {
+	var tokens []TokenData
+	result := b.db.Where("COALESCE(last_used_at, updated_at) < ?", before).Find(&tokens)
+	if result.Error != nil {
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	for i := range tokens {
+		if err := b.openToken(&tokens[i]); err != nil {
+			return nil, err
+		}
+	}
+	return tokens, nil
+}
@@ -0,0 +1,67 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// PendingCleanupInterface describes the behavior of holding cleanups while
+// the user is asked to confirm them
+type PendingCleanupInterface interface {
+	SavePendingCleanup(p *PendingCleanup) error
+	TakePendingCleanup(nonce, userID string, since time.Time) (*PendingCleanup, error)
+	PurgePendingCleanups(before time.Time) error
+}
+
+// PendingCleanup holds the options of a cleanup until the user confirms it,
+// so the prompt only has to carry the nonce
+type PendingCleanup struct {
+	Nonce   string `gorm:"primary_key"`
+	TeamID  string
+	UserID  string
+	Channel string
+	// Options are the JSON encoded options of the cleanup
+	Options      string
+	GraceSeconds int
+	RequestID    string
+	CreatedAt    time.Time `gorm:"index"`
+}
+
+// SavePendingCleanup stores a cleanup awaiting confirmation
+func (b *Backend) SavePendingCleanup(p *PendingCleanup) error {
+	if result := b.db.Create(p); result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
+
+// TakePendingCleanup removes and returns the cleanup the user saved under
+// nonce after since. Only one caller gets it, so a confirmation clicked twice
+// enqueues a single cleanup.
+func (b *Backend) TakePendingCleanup(nonce, userID string, since time.Time) (*PendingCleanup, error) {
+	var p PendingCleanup
+	result := b.db.Where("nonce = ? AND user_id = ? AND created_at >= ?", nonce, userID, since).First(&p)
+	if result.Error != nil {
+		if gorm.IsRecordNotFoundError(result.Error) {
+			return nil, ErrRecordNotFound
+		}
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	result = b.db.Where("nonce = ?", nonce).Delete(&PendingCleanup{})
+	if result.Error != nil {
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return nil, ErrRecordNotFound
+	}
+	return &p, nil
+}
+
+// PurgePendingCleanups removes cleanups that were never confirmed
+func (b *Backend) PurgePendingCleanups(before time.Time) error {
+	if result := b.db.Where("created_at < ?", before).Delete(&PendingCleanup{}); result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+package backend
+
+import (
+	"time"
+)
+
+// ProcessedEventInterface describes the behavior of deduplicating Events API deliveries
+type ProcessedEventInterface interface {
+	MarkEventProcessed(eventID string) (bool, error)
+	UnmarkEventProcessed(eventID string) error
+	PurgeProcessedEvents(before time.Time) error
+}
+
+// ProcessedEvent records an Events API event that was handled
+type ProcessedEvent struct {
+	EventID   string    `gorm:"primary_key"`
+	CreatedAt time.Time `gorm:"index"`
+}
+
+// MarkEventProcessed records an event ID, reporting false when it was
+// already recorded
+func (b *Backend) MarkEventProcessed(eventID string) (bool, error) {
+	result := b.db.Exec("INSERT INTO processed_events (event_id, created_at) VALUES (?, ?) ON CONFLICT DO NOTHING",
+		eventID, time.Now())
+	if result.Error != nil {
+		return false, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return result.RowsAffected == 1, nil
+}
+
+// UnmarkEventProcessed removes an event ID
+func (b *Backend) UnmarkEventProcessed(eventID string) error {
+	if result := b.db.Where("event_id = ?", eventID).Delete(&ProcessedEvent{}); result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
+
+// PurgeProcessedEvents removes event IDs recorded before the given time
+func (b *Backend) PurgeProcessedEvents(before time.Time) error {
+	if result := b.db.Where("created_at < ?", before).Delete(&ProcessedEvent{}); result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package backend
+
+import (
+	"time"
+
+	"github.com/jinzhu/gorm"
+)
+
+// RetentionPolicyInterface describes the behavior of accessing retention policies
+type RetentionPolicyInterface interface {
+	CreateRetentionPolicy(p *RetentionPolicy) error
+	DeleteRetentionPolicy(userID string, id uint) error
+	GetRetentionPoliciesByUserID(userID string) ([]RetentionPolicy, error)
+	GetDueRetentionPolicies(now time.Time) ([]RetentionPolicy, error)
+	ClaimRetentionPolicy(p *RetentionPolicy, next time.Time) (bool, error)
+}
+
+// RetentionPolicy describes a cleanup a user wants applied to a channel on a schedule
+type RetentionPolicy struct {
+	gorm.Model
+	UserID string `gorm:"index"`
+	TeamID string
+	// EnterpriseID is set for workspaces of an Enterprise Grid org
+	EnterpriseID string
+	ChannelID    string
+	// Schedule is a cron expression evaluated in UTC
+	Schedule      string
+	Messages      bool
+	Files         bool
+	Bots          bool
+	OlderThanDays int
+	KeepLast      int
+	NextRunAt     time.Time `gorm:"index"`
+}
+
+// CreateRetentionPolicy adds a retention policy to the database
+func (b *Backend) CreateRetentionPolicy(p *RetentionPolicy) error {
+	if result := b.db.Create(p); result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	return nil
+}
+
+// DeleteRetentionPolicy removes a retention policy owned by the user
+func (b *Backend) DeleteRetentionPolicy(userID string, id uint) error {
+	result := b.db.Where("user_id = ?", userID).Delete(&RetentionPolicy{Model: gorm.Model{ID: id}})
+	if result.Error != nil {
+		return ErrDatabaseGeneral(result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+	return nil
+}
+
+// GetRetentionPoliciesByUserID gets all retention policies of a user
+func (b *Backend) GetRetentionPoliciesByUserID(userID string) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	if result := b.db.Where("user_id = ?", userID).Order("id").Find(&policies); result.Error != nil {
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return policies, nil
+}
+
+// GetDueRetentionPolicies gets the retention policies whose next run is due
+func (b *Backend) GetDueRetentionPolicies(now time.Time) ([]RetentionPolicy, error) {
+	var policies []RetentionPolicy
+	if result := b.db.Where("next_run_at <= ?", now).Order("next_run_at").Find(&policies); result.Error != nil {
+		return nil, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return policies, nil
+}
+
+// ClaimRetentionPolicy moves the next run of a due policy forward. Only one of
+// several concurrent callers succeeds, which makes it safe to schedule from
+// every dyno.
+func (b *Backend) ClaimRetentionPolicy(p *RetentionPolicy, next time.Time) (bool, error) {
+	result := b.db.Model(&RetentionPolicy{}).
+		Where("id = ? AND next_run_at = ?", p.ID, p.NextRunAt).
+		Update("next_run_at", next)
+	if result.Error != nil {
+		return false, ErrDatabaseGeneral(result.Error.Error())
+	}
+	if result.RowsAffected == 0 {
+		return false, nil
+	}
+	p.NextRunAt = next
+	return true, nil
+}
@@ -0,0 +1,55 @@
+package backend
+
+import (
+	"net/url"
+
+	"github.com/jinzhu/gorm"
+	_ "github.com/jinzhu/gorm/dialects/sqlite" // per gorm
+)
+
+// sqliteBusyTimeout is how many milliseconds go-sqlite3 waits for a lock
+// held by another connection, like the queue sharing the file, before
+// failing with database is locked
+const sqliteBusyTimeout = "5000"
+
+// InitSQLite opens a SQLite database for single node deployments. The
+// migrations package targets Postgres, so the SQLite schema is kept up to
+// date by gorm instead.
+func InitSQLite(u *url.URL) (*Backend, error) {
+	db, err := gorm.Open("sqlite3", SQLitePath(u))
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite allows a single writer, serialize access instead of failing
+	// with database is locked
+	db.DB().SetMaxOpenConns(1)
+
+	if err := db.AutoMigrate(&TokenData{}, &RetentionPolicy{}, &AutoExpire{}, &ProcessedEvent{}, &TaskRun{}, &PendingCleanup{}).Error; err != nil {
+		db.Close()
+		return nil, err
+	}
+	if err := db.Model(&TokenData{}).AddUniqueIndex("idx_token_data_team_user", "team_id", "user_id").Error; err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &Backend{
+		db: db,
+	}, nil
+}
+
+// SQLitePath turns sqlite:///abs/path.db, sqlite://rel/path.db and
+// sqlite:path.db into the file name and options go-sqlite3 expects, waiting
+// for locks unless the URL sets its own _busy_timeout
+func SQLitePath(u *url.URL) string {
+	path := u.Opaque
+	if path == "" {
+		path = u.Host + u.Path
+	}
+	query := u.Query()
+	if query.Get("_busy_timeout") == "" {
+		query.Set("_busy_timeout", sqliteBusyTimeout)
+	}
+	return path + "?" + query.Encode()
+}
@@ -0,0 +1,30 @@
+package backend
+
+import (
+	"time"
+)
+
+// TaskRunInterface describes the behavior of sharing periodic tasks between
+// processes
+type TaskRunInterface interface {
+	ClaimTaskRun(name string, now, since time.Time) (bool, error)
+}
+
+// TaskRun records when a periodic task last ran
+type TaskRun struct {
+	Name  string `gorm:"primary_key"`
+	RanAt time.Time
+}
+
+// ClaimTaskRun records a run of the named task at now unless one was recorded
+// after since. Only one of several concurrent callers succeeds, which makes it
+// safe to run periodic tasks from every dyno.
+func (b *Backend) ClaimTaskRun(name string, now, since time.Time) (bool, error) {
+	result := b.db.Exec("INSERT INTO task_runs (name, ran_at) VALUES (?, ?) "+
+		"ON CONFLICT (name) DO UPDATE SET ran_at = excluded.ran_at WHERE task_runs.ran_at < ?",
+		name, now.UTC(), since.UTC())
+	if result.Error != nil {
+		return false, ErrDatabaseGeneral(result.Error.Error())
+	}
+	return result.RowsAffected == 1, nil
+}
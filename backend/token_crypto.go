@@ -0,0 +1,203 @@
+package backend
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// sealedPrefix marks access tokens stored with envelope encryption, tokens
+// without it were written before encryption was turned on
+const sealedPrefix = "enc:v1:"
+
+// Keyring holds the key-encryption keys used to protect access tokens at
+// rest. Every token is encrypted with its own data key, which in turn is
+// encrypted with the primary key. Older keys only decrypt, so rows written
+// before a rotation stay readable until they are re-encrypted
+type Keyring struct {
+	primary string
+	keys    map[string]cipher.AEAD
+}
+
+// NewKeyring builds a keyring from base64 encoded 32 byte keys, the first of
+// which encrypts new tokens
+func NewKeyring(encodedKeys ...string) (*Keyring, error) {
+	k := &Keyring{keys: make(map[string]cipher.AEAD)}
+	for _, encoded := range encodedKeys {
+		key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+		if err != nil {
+			return nil, errors.Wrap(err, "Unable to decode key")
+		}
+		if len(key) != 32 {
+			return nil, fmt.Errorf("key must be 32 bytes, got %d", len(key))
+		}
+		aead, err := newAEAD(key)
+		if err != nil {
+			return nil, err
+		}
+		sum := sha256.Sum256(key)
+		id := hex.EncodeToString(sum[:4])
+		if k.primary == "" {
+			k.primary = id
+		}
+		k.keys[id] = aead
+	}
+	if k.primary == "" {
+		return nil, errors.New("at least one key is required")
+	}
+	return k, nil
+}
+
+// Seal encrypts a token with a fresh data key wrapped by the primary key
+func (k *Keyring) Seal(token string) (string, error) {
+	dek := make([]byte, 32)
+	if _, err := io.ReadFull(rand.Reader, dek); err != nil {
+		return "", err
+	}
+	wrapped, err := seal(k.keys[k.primary], dek)
+	if err != nil {
+		return "", err
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	sealed, err := seal(aead, []byte(token))
+	if err != nil {
+		return "", err
+	}
+	return sealedPrefix + k.primary + ":" +
+		base64.RawStdEncoding.EncodeToString(wrapped) + ":" +
+		base64.RawStdEncoding.EncodeToString(sealed), nil
+}
+
+// Open decrypts a token sealed with any key of the keyring, tokens stored in
+// plaintext are returned unchanged
+func (k *Keyring) Open(value string) (string, error) {
+	if !strings.HasPrefix(value, sealedPrefix) {
+		return value, nil
+	}
+	parts := strings.Split(strings.TrimPrefix(value, sealedPrefix), ":")
+	if len(parts) != 3 {
+		return "", errors.New("malformed sealed token")
+	}
+	kek, ok := k.keys[parts[0]]
+	if !ok {
+		return "", fmt.Errorf("token sealed with unknown key %s", parts[0])
+	}
+	wrapped, err := base64.RawStdEncoding.DecodeString(parts[1])
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to decode data key")
+	}
+	sealed, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to decode token")
+	}
+	dek, err := open(kek, wrapped)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to decrypt data key")
+	}
+	aead, err := newAEAD(dek)
+	if err != nil {
+		return "", err
+	}
+	token, err := open(aead, sealed)
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to decrypt token")
+	}
+	return string(token), nil
+}
+
+// current reports whether a stored value is sealed with the primary key
+func (k *Keyring) current(value string) bool {
+	return strings.HasPrefix(value, sealedPrefix+k.primary+":")
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal prepends the random nonce to the ciphertext
+func seal(aead cipher.AEAD, plaintext []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func open(aead cipher.AEAD, ciphertext []byte) ([]byte, error) {
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, nil)
+}
+
+// UseKeyring turns on encryption of access tokens and re-encrypts every
+// stored token that is in plaintext or sealed with an older key
+func (b *Backend) UseKeyring(k *Keyring) (int, error) {
+	b.keys = k
+	var rows []TokenData
+	if result := b.db.Unscoped().Select("id, access_token").Find(&rows); result.Error != nil {
+		return 0, ErrDatabaseGeneral(result.Error.Error())
+	}
+	rotated := 0
+	for _, row := range rows {
+		if k.current(row.AccessToken) {
+			continue
+		}
+		token, err := k.Open(row.AccessToken)
+		if err != nil {
+			return rotated, errors.Wrapf(err, "Unable to decrypt token %d", row.ID)
+		}
+		sealed, err := k.Seal(token)
+		if err != nil {
+			return rotated, err
+		}
+		result := b.db.Unscoped().Model(&TokenData{}).Where("id = ?", row.ID).UpdateColumn("access_token", sealed)
+		if result.Error != nil {
+			return rotated, ErrDatabaseGeneral(result.Error.Error())
+		}
+		rotated++
+	}
+	return rotated, nil
+}
+
+// sealToken returns a copy of t with the access token encrypted
+func (b *Backend) sealToken(t *TokenData) (*TokenData, error) {
+	sealed := *t
+	if b.keys == nil || sealed.AccessToken == "" {
+		return &sealed, nil
+	}
+	var err error
+	if sealed.AccessToken, err = b.keys.Seal(t.AccessToken); err != nil {
+		return nil, errors.Wrap(err, "Unable to encrypt token")
+	}
+	return &sealed, nil
+}
+
+// openToken decrypts the access token of t in place
+func (b *Backend) openToken(t *TokenData) error {
+	if b.keys == nil {
+		return nil
+	}
+	token, err := b.keys.Open(t.AccessToken)
+	if err != nil {
+		return err
+	}
+	t.AccessToken = token
+	return nil
+}
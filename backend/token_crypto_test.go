@@ -0,0 +1,176 @@
+package backend
+
+import (
+	"encoding/base64"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+var (
+	testKey1 = base64.StdEncoding.EncodeToString([]byte("0123456789abcdef0123456789abcdef"))
+	testKey2 = base64.StdEncoding.EncodeToString([]byte("fedcba9876543210fedcba9876543210"))
+)
+
+func mustKeyring(t *testing.T, keys ...string) *Keyring {
+	t.Helper()
+	k, err := NewKeyring(keys...)
+	if err != nil {
+		t.Fatalf("NewKeyring: %v", err)
+	}
+	return k
+}
+
+func TestNewKeyring(t *testing.T) {
+	tests := []struct {
+		name    string
+		keys    []string
+		wantErr bool
+	}{
+		{"single key", []string{testKey1}, false},
+		{"primary and old key", []string{testKey2, testKey1}, false},
+		{"no key", nil, true},
+		{"not base64", []string{"not base64!"}, true},
+		{"short key", []string{base64.StdEncoding.EncodeToString([]byte("short"))}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewKeyring(tt.keys...)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("NewKeyring() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyringRoundTrip(t *testing.T) {
+	k := mustKeyring(t, testKey1)
+	for _, token := range []string{"xoxp-1234-5678", "", strings.Repeat("x", 500)} {
+		sealed, err := k.Seal(token)
+		if err != nil {
+			t.Fatalf("Seal(%q): %v", token, err)
+		}
+		if !strings.HasPrefix(sealed, sealedPrefix) {
+			t.Errorf("Seal(%q) = %q, want the %q prefix", token, sealed, sealedPrefix)
+		}
+		if token != "" && strings.Contains(sealed, token) {
+			t.Errorf("Seal(%q) leaks the token", token)
+		}
+		opened, err := k.Open(sealed)
+		if err != nil {
+			t.Fatalf("Open: %v", err)
+		}
+		if opened != token {
+			t.Errorf("Open(Seal(%q)) = %q", token, opened)
+		}
+	}
+}
+
+func TestKeyringSealIsRandomized(t *testing.T) {
+	k := mustKeyring(t, testKey1)
+	a, _ := k.Seal("xoxp-1")
+	b, _ := k.Seal("xoxp-1")
+	if a == b {
+		t.Error("sealing the same token twice gave the same value")
+	}
+}
+
+func TestKeyringOpen(t *testing.T) {
+	old := mustKeyring(t, testKey1)
+	sealed, err := old.Seal("xoxp-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	parts := strings.Split(sealed, ":")
+	tampered := strings.Join(append(parts[:len(parts)-1], "A"+parts[len(parts)-1][1:]), ":")
+	if tampered == sealed {
+		tampered = strings.Join(append(parts[:len(parts)-1], "B"+parts[len(parts)-1][1:]), ":")
+	}
+
+	tests := []struct {
+		name    string
+		keys    []string
+		value   string
+		want    string
+		wantErr bool
+	}{
+		{"plaintext passes through", []string{testKey1}, "xoxp-plain", "xoxp-plain", false},
+		{"sealed with the primary key", []string{testKey1}, sealed, "xoxp-1", false},
+		{"sealed with an old key", []string{testKey2, testKey1}, sealed, "xoxp-1", false},
+		{"sealed with an unknown key", []string{testKey2}, sealed, "", true},
+		{"tampered ciphertext", []string{testKey1}, tampered, "", true},
+		{"malformed", []string{testKey1}, sealedPrefix + "abc", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := mustKeyring(t, tt.keys...).Open(tt.value)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Open() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("Open() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// storedToken reads the access token column as written to the database
+func storedToken(t *testing.T, b *Backend) string {
+	t.Helper()
+	var row TokenData
+	if err := b.db.Unscoped().Select("id, access_token").First(&row).Error; err != nil {
+		t.Fatal(err)
+	}
+	return row.AccessToken
+}
+
+func TestUseKeyringRotation(t *testing.T) {
+	u, _ := url.Parse("sqlite::memory:")
+	b, err := InitSQLite(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Close()
+
+	td := &TokenData{OAuthResponse: slack.OAuthResponse{AccessToken: "xoxp-secret", TeamID: "T1", UserID: "U1"}}
+	if err := b.CreateTokenData(td); err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		name        string
+		keys        []string
+		wantRotated int
+	}{
+		{"encrypt plaintext rows", []string{testKey1}, 1},
+		{"nothing to do with the same key", []string{testKey1}, 0},
+		{"rotate to a new key", []string{testKey2, testKey1}, 1},
+		{"old key dropped", []string{testKey2}, 0},
+	}
+	for _, step := range steps {
+		k := mustKeyring(t, step.keys...)
+		rotated, err := b.UseKeyring(k)
+		if err != nil {
+			t.Fatalf("%s: UseKeyring: %v", step.name, err)
+		}
+		if rotated != step.wantRotated {
+			t.Errorf("%s: rotated %d tokens, want %d", step.name, rotated, step.wantRotated)
+		}
+		if stored := storedToken(t, b); !k.current(stored) {
+			t.Errorf("%s: stored token %q is not sealed with the primary key", step.name, stored)
+		}
+		got, err := b.GetTokenData("T1", "", "U1")
+		if err != nil {
+			t.Fatalf("%s: GetTokenData: %v", step.name, err)
+		}
+		if got.AccessToken != "xoxp-secret" {
+			t.Errorf("%s: GetTokenData returned token %q", step.name, got.AccessToken)
+		}
+	}
+
+	if _, err := b.UseKeyring(mustKeyring(t, testKey1)); err == nil {
+		t.Error("UseKeyring with only a retired key succeeded")
+	}
+}
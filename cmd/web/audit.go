@@ -0,0 +1,158 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/king-jam/channel-cleaner/queue"
+	"github.com/nlopes/slack"
+)
+
+var auditUsage = "Usage: /clean audit [here] [--since=YYYY-MM-DD]"
+
+const (
+	// auditListLimit is how many entries /clean audit shows, the export
+	// has all of them
+	auditListLimit = 20
+	// auditExportTTL is how long an export link works
+	auditExportTTL = 15 * time.Minute
+)
+
+// auditExporter signs links to the CSV export of the audit log so the
+// export needs no login: whoever holds the link until it expires can
+// download what /clean audit showed
+type auditExporter struct {
+	secret string
+	url    string
+}
+
+// newAuditExporter serves the export next to the OAuth redirect
+func newAuditExporter(secret, redirectURI string) (auditExporter, error) {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return auditExporter{}, err
+	}
+	u.Path, u.RawQuery, u.Fragment = "/audit.csv", "", ""
+	return auditExporter{secret: secret, url: u.String()}, nil
+}
+
+// link returns the export URL of the entries matching query
+func (a auditExporter) link(query queue.AuditQuery, now time.Time) string {
+	values := url.Values{}
+	values.Set("team", query.TeamID)
+	values.Set("user", query.UserID)
+	values.Set("channel", query.Channel)
+	if !query.Since.IsZero() {
+		values.Set("since", strconv.FormatInt(query.Since.Unix(), 10))
+	}
+	values.Set("expires", strconv.FormatInt(now.Add(auditExportTTL).Unix(), 10))
+	values.Set("sig", a.sign(values))
+	return a.url + "?" + values.Encode()
+}
+
+// query checks the signature and expiry of an export link and returns the
+// query it was issued for
+func (a auditExporter) query(values url.Values, now time.Time) (queue.AuditQuery, error) {
+	signature := values.Get("sig")
+	values.Del("sig")
+	if !hmac.Equal([]byte(signature), []byte(a.sign(values))) {
+		return queue.AuditQuery{}, errors.New("export link signature mismatch")
+	}
+	expiry, err := strconv.ParseInt(values.Get("expires"), 10, 64)
+	if err != nil {
+		return queue.AuditQuery{}, errors.New("malformed export link")
+	}
+	if now.Unix() > expiry {
+		return queue.AuditQuery{}, errors.New("export link expired")
+	}
+	query := queue.AuditQuery{
+		TeamID:  values.Get("team"),
+		UserID:  values.Get("user"),
+		Channel: values.Get("channel"),
+	}
+	if since := values.Get("since"); since != "" {
+		s, err := strconv.ParseInt(since, 10, 64)
+		if err != nil {
+			return queue.AuditQuery{}, errors.New("malformed export link")
+		}
+		query.Since = time.Unix(s, 0)
+	}
+	return query, nil
+}
+
+func (a auditExporter) sign(values url.Values) string {
+	mac := hmac.New(sha256.New, []byte(a.secret))
+	mac.Write([]byte("audit-export:" + values.Encode()))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// auditCommand handles /clean audit. Workspace admins and owners see every
+// deletion of the workspace, other users only their own. When the admin check
+// cannot run, e.g. on installs without users:read, only the own entries are shown.
+func auditCommand(qc queue.Queue, exporter auditExporter, token string, slashCommand slack.SlashCommand, rawText string) (slack.Msg, error) {
+	query := queue.AuditQuery{TeamID: slashCommand.TeamID}
+	for _, field := range strings.Fields(rawText) {
+		switch {
+		case field == "here":
+			query.Channel = slashCommand.ChannelID
+		case strings.HasPrefix(field, "--since="):
+			since, err := time.Parse(queue.DateLayout, strings.TrimPrefix(field, "--since="))
+			if err != nil {
+				return errorResponseMessage("Invalid --since, expected a date like --since=2019-01-31"), nil
+			}
+			query.Since = since
+		default:
+			return errorResponseMessage(auditUsage), nil
+		}
+	}
+	user, err := slack.New(token, metrics.SlackClient).GetUserInfo(slashCommand.UserID)
+	if err != nil {
+		slog.Warn("unable to check whether the user is an admin", "user_id", slashCommand.UserID, "error", err)
+	}
+	if err != nil || (!user.IsAdmin && !user.IsOwner) {
+		query.UserID = slashCommand.UserID
+	}
+	list := query
+	list.Limit = auditListLimit
+	entries, err := qc.AuditLog(list)
+	if err != nil {
+		return slack.Msg{}, err
+	}
+	return auditResponseMessage(entries, exporter.link(query, time.Now())), nil
+}
+
+func auditResponseMessage(entries []queue.AuditEntry, exportURL string) slack.Msg {
+	if len(entries) == 0 {
+		return errorResponseMessage("No deletions were recorded")
+	}
+	lines := make([]string, 0, len(entries)+1)
+	for _, e := range entries {
+		item := "message " + e.Timestamp
+		if e.FileID != "" {
+			item = "file " + e.FileID
+		}
+		line := fmt.Sprintf("%s <@%s> %s (%s) in <#%s>, job %d: %s", e.AttemptedAt.UTC().Format("2006-01-02 15:04 MST"),
+			e.UserID, item, e.Category, e.Channel, e.JobID, e.Outcome)
+		if e.Outcome == queue.OutcomeFailed {
+			line += " (" + e.SlackError + ")"
+		}
+		lines = append(lines, line)
+	}
+	if len(entries) == auditListLimit {
+		lines = append(lines, fmt.Sprintf("Showing the latest %d deletions.", auditListLimit))
+	}
+	lines = append(lines, fmt.Sprintf("<%s|Download the full log as CSV> (the link expires in %d minutes)", exportURL, int(auditExportTTL.Minutes())))
+	return slack.Msg{
+		Text:         strings.Join(lines, "\n"),
+		ResponseType: "ephemeral",
+	}
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/queue"
+)
+
+func TestAuditExportLink(t *testing.T) {
+	exporter, err := newAuditExporter("client-secret", "https://cleaner.example.com/auth/redirect?x=1")
+	if err != nil {
+		t.Fatalf("newAuditExporter: %v", err)
+	}
+	issued := time.Unix(1546300800, 0)
+	query := queue.AuditQuery{TeamID: "T1", UserID: "U1", Channel: "C1", Since: time.Unix(1546214400, 0)}
+	link := exporter.link(query, issued)
+	if !strings.HasPrefix(link, "https://cleaner.example.com/audit.csv?") {
+		t.Fatalf("link = %s, want it served from /audit.csv", link)
+	}
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatalf("url.Parse: %v", err)
+	}
+	with := func(key, value string) url.Values {
+		v := u.Query()
+		v.Set(key, value)
+		return v
+	}
+	without := func(key string) url.Values {
+		v := u.Query()
+		v.Del(key)
+		return v
+	}
+	other, _ := newAuditExporter("another secret", "https://cleaner.example.com/auth/redirect")
+	tests := []struct {
+		name     string
+		exporter auditExporter
+		values   url.Values
+		now      time.Time
+		want     queue.AuditQuery
+		wantErr  string
+	}{
+		{"valid", exporter, u.Query(), issued.Add(time.Minute), query, ""},
+		{"valid until expiry", exporter, u.Query(), issued.Add(auditExportTTL), query, ""},
+		{"expired", exporter, u.Query(), issued.Add(auditExportTTL + time.Second), queue.AuditQuery{}, "export link expired"},
+		{"other user", exporter, with("user", "U2"), issued, queue.AuditQuery{}, "export link signature mismatch"},
+		{"whole workspace", exporter, with("user", ""), issued, queue.AuditQuery{}, "export link signature mismatch"},
+		{"other team", exporter, with("team", "T2"), issued, queue.AuditQuery{}, "export link signature mismatch"},
+		{"extended expiry", exporter, with("expires", "9999999999"), issued, queue.AuditQuery{}, "export link signature mismatch"},
+		{"tampered signature", exporter, with("sig", strings.Repeat("0", 64)), issued, queue.AuditQuery{}, "export link signature mismatch"},
+		{"unsigned", exporter, without("sig"), issued, queue.AuditQuery{}, "export link signature mismatch"},
+		{"other secret", other, u.Query(), issued, queue.AuditQuery{}, "export link signature mismatch"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.exporter.query(tt.values, tt.now)
+			if tt.wantErr != "" {
+				if err == nil || err.Error() != tt.wantErr {
+					t.Fatalf("query() error = %v, want %s", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("query() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("query() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/events"
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/king-jam/channel-cleaner/queue"
+	"github.com/nlopes/slack"
+)
+
+var expireUsage = "Usage: /clean expire DURATION (like 30m, 12h or 7d), /clean expire off or /clean expire list"
+
+// freshFileWindow is how soon after its upload a shared file counts as new.
+// Older files are re-shares, and deleting them would remove them from every
+// conversation they were shared to.
+const freshFileWindow = 5 * time.Minute
+
+// autoExpireSubTypes are the message subtypes that are the user's own
+// content. Edits, deletions and channel notices are ignored.
+var autoExpireSubTypes = map[string]bool{
+	"":                 true,
+	"file_share":       true,
+	"me_message":       true,
+	"thread_broadcast": true,
+}
+
+// expireCommand handles the /clean expire subcommands
+func expireCommand(db backend.Database, slashCommand slack.SlashCommand, rawText string) (slack.Msg, error) {
+	arg := strings.TrimSpace(rawText)
+	switch arg {
+	case "":
+		return errorResponseMessage(expireUsage), nil
+	case "off":
+		if err := db.DeleteAutoExpire(slashCommand.UserID, slashCommand.ChannelID); err != nil {
+			if err == backend.ErrRecordNotFound {
+				return errorResponseMessage("Auto expire is not on in this channel"), nil
+			}
+			return slack.Msg{}, err
+		}
+		return errorResponseMessage("Auto expire turned off in this channel"), nil
+	case "list":
+		settings, err := db.GetAutoExpiresByUserID(slashCommand.UserID)
+		if err != nil {
+			return slack.Msg{}, err
+		}
+		if len(settings) == 0 {
+			return errorResponseMessage("Auto expire is not on in any channel"), nil
+		}
+		lines := make([]string, 0, len(settings))
+		for _, a := range settings {
+			lines = append(lines, fmt.Sprintf("<#%s>: %s", a.ChannelID, time.Duration(a.TTLSeconds)*time.Second))
+		}
+		return errorResponseMessage(strings.Join(lines, "\n")), nil
+	}
+	ttl, err := parseTTL(arg)
+	if err != nil {
+		return errorResponseMessage(expireUsage), nil
+	}
+	err = db.SetAutoExpire(&backend.AutoExpire{
+		UserID:       slashCommand.UserID,
+		TeamID:       slashCommand.TeamID,
+		EnterpriseID: slashCommand.EnterpriseID,
+		ChannelID:    slashCommand.ChannelID,
+		TTLSeconds:   int(ttl / time.Second),
+	})
+	if err != nil {
+		return slack.Msg{}, err
+	}
+	return errorResponseMessage(fmt.Sprintf("Everything you post in this channel from now on will be deleted after %s", ttl)), nil
+}
+
+// parseTTL accepts Go durations plus a d suffix for days
+func parseTTL(s string) (time.Duration, error) {
+	var ttl time.Duration
+	if strings.HasSuffix(s, "d") {
+		days, err := strconv.Atoi(strings.TrimSuffix(s, "d"))
+		if err != nil {
+			return 0, err
+		}
+		ttl = time.Duration(days) * 24 * time.Hour
+	} else {
+		var err error
+		if ttl, err = time.ParseDuration(s); err != nil {
+			return 0, err
+		}
+	}
+	if ttl < time.Minute {
+		return 0, fmt.Errorf("duration too short")
+	}
+	return ttl, nil
+}
+
+// expireMessage schedules the deletion of a message posted by an opted in user
+func expireMessage(ctx context.Context, db backend.Database, qc queue.Queue, teamID string, e events.MessageEvent) error {
+	if e.User == "" || !autoExpireSubTypes[e.SubType] {
+		return nil
+	}
+	a, t, err := autoExpireToken(db, e.User, e.Channel)
+	if err != nil || a == nil {
+		return err
+	}
+	runAt := time.Now().Add(time.Duration(a.TTLSeconds) * time.Second)
+	return qc.QueueDelayedDelete(ctx, teamID, t.EnterpriseID, e.Channel, e.User, e.Timestamp, runAt)
+}
+
+// expireFile schedules the deletion of a file an opted in user just uploaded
+// to the channel. Re-shares of older files and files of others are left alone.
+func expireFile(ctx context.Context, db backend.Database, qc queue.Queue, teamID string, e events.FileSharedEvent) error {
+	if e.UserID == "" || e.ChannelID == "" {
+		return nil
+	}
+	a, t, err := autoExpireToken(db, e.UserID, e.ChannelID)
+	if err != nil || a == nil {
+		return err
+	}
+	f, _, _, err := slack.New(t.AccessToken, metrics.SlackClient).GetFileInfo(e.FileID, 1, 1)
+	if err != nil {
+		slog.Warn("unable to look up the shared file, not expiring it", "request_id", logging.RequestID(ctx), "file_id", e.FileID, "error", err)
+		return nil
+	}
+	if !freshUpload(f, e) {
+		return nil
+	}
+	runAt := time.Now().Add(time.Duration(a.TTLSeconds) * time.Second)
+	return qc.QueueDelayedFileDelete(ctx, teamID, t.EnterpriseID, e.ChannelID, e.UserID, e.FileID, runAt)
+}
+
+// freshUpload reports whether the shared file was uploaded by the user who
+// shared it, shortly before the event
+func freshUpload(f *slack.File, e events.FileSharedEvent) bool {
+	if f.User != e.UserID {
+		return false
+	}
+	sharedAt := time.Now()
+	if ts, err := strconv.ParseFloat(e.EventTS, 64); err == nil {
+		sharedAt = time.Unix(int64(ts), 0)
+	}
+	return sharedAt.Sub(f.Created.Time()) <= freshFileWindow
+}
+
+// autoExpireToken looks up the setting and token of a user in a channel,
+// returning nil when the user has not opted in
+func autoExpireToken(db backend.Database, userID, channelID string) (*backend.AutoExpire, *backend.TokenData, error) {
+	a, err := db.GetAutoExpire(userID, channelID)
+	if err == backend.ErrRecordNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	t, err := db.GetTokenData(a.TeamID, a.EnterpriseID, userID)
+	if err == backend.ErrRecordNotFound {
+		return nil, nil, nil
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	if err := db.TouchTokenData(t.ID); err != nil {
+		slog.Warn("unable to record token use", "user_id", userID, "error", err)
+	}
+	return a, t, nil
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/king-jam/channel-cleaner/queue"
+	"github.com/nlopes/slack"
+)
+
+// cleanDialogCallback identifies submissions of the /clean dialog
+const cleanDialogCallback = "clean_dialog"
+
+// dialogError flags a single invalid element of a dialog submission
+type dialogError struct {
+	Name  string `json:"name"`
+	Error string `json:"error"`
+}
+
+// cleanDialog builds the dialog opened by /clean without arguments, with
+// every element preset to the defaults of the command
+func cleanDialog(defaults queue.CleanChannelOpts) slack.Dialog {
+	yesNo := func(name, label string, value bool) slack.DialogInputSelect {
+		return slack.DialogInputSelect{
+			DialogInput: slack.DialogInput{Type: slack.InputTypeSelect, Label: label, Name: name},
+			Value:       strconv.FormatBool(value),
+			Options: []slack.DialogSelectOption{
+				{Label: "Yes", Value: "true"},
+				{Label: "No", Value: "false"},
+			},
+		}
+	}
+	date := func(name, label string) slack.TextInputElement {
+		return slack.TextInputElement{
+			DialogInput: slack.DialogInput{
+				Type:        slack.InputTypeText,
+				Label:       label,
+				Name:        name,
+				Placeholder: "YYYY-MM-DD",
+				Optional:    true,
+			},
+			MaxLength: len(queue.DateLayout),
+			Hint:      "Leave empty for no limit",
+		}
+	}
+	threads, mode := "include", "delete"
+	if defaults.SkipThreads {
+		threads = "skip"
+	}
+	if defaults.DryRun {
+		mode = "dry_run"
+	}
+	return slack.Dialog{
+		CallbackID:  cleanDialogCallback,
+		Title:       "Clean this channel",
+		SubmitLabel: "Next",
+		Elements: []slack.DialogElement{
+			yesNo("messages", "Delete my messages", defaults.Messages),
+			yesNo("files", "Delete my files", defaults.Files),
+			yesNo("bots", "Delete bot messages", defaults.Bots),
+			slack.DialogInputSelect{
+				DialogInput: slack.DialogInput{Type: slack.InputTypeSelect, Label: "Thread replies", Name: "threads"},
+				Value:       threads,
+				Options: []slack.DialogSelectOption{
+					{Label: "Include replies inside threads", Value: "include"},
+					{Label: "Leave threads untouched", Value: "skip"},
+				},
+			},
+			date("since", "Posted on or after"),
+			date("until", "Posted on or before"),
+			slack.DialogInputSelect{
+				DialogInput: slack.DialogInput{Type: slack.InputTypeSelect, Label: "Mode", Name: "mode"},
+				Value:       mode,
+				Options: []slack.DialogSelectOption{
+					{Label: "Delete after confirmation", Value: "delete"},
+					{Label: "Dry run, only report", Value: "dry_run"},
+				},
+			},
+		},
+	}
+}
+
+// statefulDialog adds the state the vendored client lacks. Slack echoes it
+// back with the submission.
+type statefulDialog struct {
+	slack.Dialog
+	State string `json:"state,omitempty"`
+}
+
+// openDialog calls dialog.open with a state
+func openDialog(token, triggerID string, dialog slack.Dialog, state string) error {
+	body, err := json.Marshal(struct {
+		TriggerID string         `json:"trigger_id"`
+		Dialog    statefulDialog `json:"dialog"`
+	}{triggerID, statefulDialog{dialog, state}})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, slack.SLACK_API+"dialog.open", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+token)
+	resp, err := metrics.SlackHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	var result slack.SlackResponse
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("dialog.open returned %s", resp.Status)
+	}
+	return result.Err()
+}
+
+// cleanDialogOptions turns a dialog submission into cleanup options,
+// reporting invalid elements the way Slack expects them
+func cleanDialogOptions(submission map[string]string) (queue.CleanChannelOpts, []dialogError) {
+	var errs []dialogError
+	fields := []string{submission["messages"], submission["files"], submission["bots"]}
+	if submission["threads"] == "skip" {
+		fields = append(fields, "--skip-threads")
+	}
+	if submission["mode"] == "dry_run" {
+		fields = append(fields, "--dry-run")
+	}
+	for _, name := range []string{"since", "until"} {
+		value := strings.TrimSpace(submission[name])
+		if value == "" {
+			continue
+		}
+		if _, err := time.Parse(queue.DateLayout, value); err != nil {
+			errs = append(errs, dialogError{Name: name, Error: fmt.Sprintf("Expected a date like %s", queue.DateLayout)})
+			continue
+		}
+		fields = append(fields, "--"+name+"="+value)
+	}
+	if len(errs) > 0 {
+		return queue.CleanChannelOpts{}, errs
+	}
+	opts, err := parseCleanChannelFields(fields)
+	if err != nil {
+		return queue.CleanChannelOpts{}, []dialogError{{Name: "until", Error: "Must not be before the start date"}}
+	}
+	if !opts.Messages && !opts.Files && !opts.Bots {
+		return queue.CleanChannelOpts{}, []dialogError{{Name: "messages", Error: "Select something to delete"}}
+	}
+	return opts, nil
+}
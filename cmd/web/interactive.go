@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/king-jam/channel-cleaner/queue"
+	"github.com/nlopes/slack"
+)
+
+// abortCleanCallback identifies the Abort button shown during the grace period
+const abortCleanCallback = "clean_abort"
+
+// interactionPayload covers the fields of interactive_message and
+// block_actions payloads the app uses
+type interactionPayload struct {
+	Type       string `json:"type"`
+	CallbackID string `json:"callback_id"`
+	Actions    []struct {
+		Name     string `json:"name"`
+		ActionID string `json:"action_id"`
+		Value    string `json:"value"`
+	} `json:"actions"`
+	Team struct {
+		ID           string `json:"id"`
+		EnterpriseID string `json:"enterprise_id"`
+	} `json:"team"`
+	Channel struct {
+		ID string `json:"id"`
+	} `json:"channel"`
+	User struct {
+		ID string `json:"id"`
+	} `json:"user"`
+	Submission  map[string]string `json:"submission"`
+	State       string            `json:"state"`
+	ResponseURL string            `json:"response_url"`
+	TriggerID   string            `json:"trigger_id"`
+}
+
+// action returns the name and value of the clicked action
+func (p interactionPayload) action() (string, string) {
+	if len(p.Actions) == 0 {
+		return "", ""
+	}
+	a := p.Actions[0]
+	if a.ActionID != "" {
+		return a.ActionID, a.Value
+	}
+	return a.Name, a.Value
+}
+
+// confirmCleanTTL bounds how long a cleanup awaits confirmation, the
+// response_url of the prompt expires after 30 minutes anyway
+const confirmCleanTTL = time.Hour
+
+// previewCleanup holds a cleanup until the user confirms it and enqueues a
+// dry run that answers with what it would delete and the Confirm/Cancel
+// prompt. Only the nonce travels in the buttons, Slack caps their values at
+// 2000 characters.
+func previewCleanup(ctx context.Context, db backend.Database, qc queue.Queue, teamID, enterpriseID, channel, userID, responseURL string, opts queue.CleanChannelOpts, grace time.Duration) (slack.Msg, error) {
+	nonce, err := newAbortNonce()
+	if err != nil {
+		return slack.Msg{}, err
+	}
+	options, err := json.Marshal(opts)
+	if err != nil {
+		return slack.Msg{}, err
+	}
+	if err := db.PurgePendingCleanups(time.Now().Add(-confirmCleanTTL)); err != nil {
+		slog.Warn("unable to purge unconfirmed cleanups", "request_id", logging.RequestID(ctx), "error", err)
+	}
+	err = db.SavePendingCleanup(&backend.PendingCleanup{
+		Nonce:        nonce,
+		TeamID:       teamID,
+		UserID:       userID,
+		Channel:      channel,
+		Options:      string(options),
+		GraceSeconds: int(grace / time.Second),
+		RequestID:    logging.RequestID(ctx),
+	})
+	if err != nil {
+		return slack.Msg{}, err
+	}
+	opts.DryRun = true
+	if err := qc.QueueCleanChannel(ctx, teamID, enterpriseID, channel, userID, responseURL, nonce, opts, time.Time{}); err != nil {
+		return slack.Msg{}, err
+	}
+	return slack.Msg{
+		ResponseType: "ephemeral",
+		Text:         "Counting what this cleanup would delete, you will be asked to confirm it shortly.",
+	}, nil
+}
+
+// takeCleanup returns the options of the cleanup a prompt asks to confirm
+func takeCleanup(db backend.Database, nonce, userID string) (*backend.PendingCleanup, queue.CleanChannelOpts, error) {
+	var opts queue.CleanChannelOpts
+	pending, err := db.TakePendingCleanup(nonce, userID, time.Now().Add(-confirmCleanTTL))
+	if err != nil {
+		return nil, opts, err
+	}
+	if err := json.Unmarshal([]byte(pending.Options), &opts); err != nil {
+		return nil, opts, err
+	}
+	return pending, opts, nil
+}
+
+// originContext tags ctx with the ID of the /clean request an interaction
+// continues, so the job it enqueues logs under that request
+func originContext(ctx context.Context, requestID string) context.Context {
+	if !validRequestID.MatchString(requestID) {
+		return ctx
+	}
+	return logging.WithRequestID(ctx, requestID)
+}
+
+// newAbortNonce identifies a confirmed cleanup so its Abort button cancels
+// only that one
+func newAbortNonce() (string, error) {
+	b := make([]byte, 12)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// scheduledCleanMessage replaces the prompt once a cleanup is enqueued,
+// offering to abort it while it waits out the grace period
+func scheduledCleanMessage(runAt time.Time, grace time.Duration, nonce string) slack.Msg {
+	msg := slack.Msg{
+		ResponseType:    "ephemeral",
+		ReplaceOriginal: true,
+		Text:            "Cleanup Request Scheduled",
+	}
+	if grace > 0 {
+		msg.Text = fmt.Sprintf("Cleanup Request Scheduled, it starts in %s at %s", grace, runAt.UTC().Format(time.RFC1123))
+		msg.Attachments = []slack.Attachment{{
+			Fallback:   "Abort the cleanup",
+			CallbackID: abortCleanCallback,
+			Actions: []slack.AttachmentAction{
+				{Name: "abort", Text: "Abort", Type: "button", Style: "danger", Value: nonce},
+			},
+		}}
+	}
+	return msg
+}
+
+// replaceMessage replaces the interactive message with plain text
+func replaceMessage(text string) slack.Msg {
+	return slack.Msg{
+		ResponseType:    "ephemeral",
+		ReplaceOriginal: true,
+		Text:            text,
+	}
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"log/slog"
+	"regexp"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/king-jam/channel-cleaner/logging"
+)
+
+// requestIDHeader is set by the Heroku router on every request
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID keeps arbitrary client input out of the logs and job args
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// requestLogger is middleware that tags every request with an ID, reusing
+// the one the router assigned, and logs it once answered. Only the path is
+// logged since query strings carry OAuth codes and signed export links.
+func requestLogger() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		id := c.GetHeader(requestIDHeader)
+		if !validRequestID.MatchString(id) {
+			id = logging.NewRequestID()
+		}
+		c.Request = c.Request.WithContext(logging.WithRequestID(c.Request.Context(), id))
+		c.Header(requestIDHeader, id)
+		c.Next()
+		attrs := []any{
+			"request_id", id,
+			"method", c.Request.Method,
+			"path", c.Request.URL.Path,
+			"status", c.Writer.Status(),
+			"duration_ms", time.Since(start).Milliseconds(),
+			"client_ip", c.ClientIP(),
+		}
+		// slash commands name who ran what where, the text is left out
+		if form := c.Request.PostForm; form.Get("command") != "" {
+			attrs = append(attrs, "command", form.Get("command"), "team_id", form.Get("team_id"),
+				"user_id", form.Get("user_id"), "channel_id", form.Get("channel_id"))
+		}
+		slog.Info("request", attrs...)
+	}
+}
@@ -2,20 +2,29 @@ package main
 
 import (
 	"context"
+	"encoding/csv"
+	"encoding/json"
 	"fmt"
-	"log"
+	"io/ioutil"
+	"log/slog"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
 	"syscall"
 	"time"
+	"unicode"
 
 	"github.com/gin-gonic/gin"
-	"github.com/king-jam/slacko-botto/backend"
-	"github.com/king-jam/slacko-botto/queue"
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/events"
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/king-jam/channel-cleaner/queue"
+	"github.com/king-jam/channel-cleaner/scheduler"
 	"github.com/nlopes/slack"
 
 	_ "github.com/heroku/x/hmetrics/onload" // heroku metrics
@@ -31,110 +40,240 @@ var defaultCleanupOptions = queue.CleanChannelOpts{
 }
 
 func main() {
+	logging.Setup()
+
+	if len(os.Args) > 1 && os.Args[1] == "migrate" {
+		migrate(os.Args[2:])
+		return
+	}
+
 	port := os.Getenv("PORT")
 	if port == "" {
-		log.Fatal("$PORT must be set")
+		logging.Fatal("$PORT must be set")
 	}
 
 	dbString := os.Getenv("DATABASE_URL")
 	if dbString == "" {
-		log.Fatal("$DATABASE_URL must be set")
+		logging.Fatal("$DATABASE_URL must be set")
 	}
 	dbURL, err := url.Parse(dbString)
 	if err != nil {
-		log.Fatal("Invalid Database URL format")
+		logging.Fatal("Invalid Database URL format")
 	}
 
-	db, err := backend.InitDatabase(dbURL)
+	// QUEUE_URL points the job queue at another database, by default it
+	// shares DATABASE_URL. With SQLite or memory the workers run in process.
+	queueString := os.Getenv("QUEUE_URL")
+	if queueString == "" {
+		queueString = dbString
+	}
+	queueURL, err := url.Parse(queueString)
 	if err != nil {
-		log.Fatal("Unable to initialize the Database")
+		logging.Fatal("Invalid Queue URL format")
+	}
+
+	for _, target := range migrationTargets() {
+		if err := runMigrations(target); err != nil {
+			logging.Fatal("Unable to migrate the Database", "error", err)
+		}
+	}
+
+	db, err := backend.Open(dbURL)
+	if err != nil {
+		logging.Fatal("Unable to initialize the Database", "error", err)
 	}
 	defer db.Close()
 
-	qc, err := queue.NewQueue(dbURL)
+	// TOKEN_ENCRYPTION_KEY encrypts access tokens at rest, keys it replaced go
+	// in TOKEN_ENCRYPTION_OLD_KEYS until every token is re-encrypted
+	encryptionKey := os.Getenv("TOKEN_ENCRYPTION_KEY")
+	if encryptionKey == "" {
+		logging.Fatal("$TOKEN_ENCRYPTION_KEY must be set")
+	}
+	keys := []string{encryptionKey}
+	if oldKeys := os.Getenv("TOKEN_ENCRYPTION_OLD_KEYS"); oldKeys != "" {
+		keys = append(keys, strings.Split(oldKeys, ",")...)
+	}
+	keyring, err := backend.NewKeyring(keys...)
 	if err != nil {
-		log.Fatal("Unable to initialize the Database")
+		logging.Fatal("Unable to load token encryption keys", "error", err)
+	}
+	rotated, err := db.UseKeyring(keyring)
+	if err != nil {
+		logging.Fatal("Unable to re-encrypt tokens", "error", err)
+	}
+	if rotated > 0 {
+		slog.Info("re-encrypted tokens with the current key", "tokens", rotated)
+	}
+
+	qc, err := queue.Open(queueURL, db)
+	if err != nil {
+		logging.Fatal("Unable to initialize the Queue", "error", err)
 	}
 	defer qc.Close()
 
 	qc.InitWorkerPool(2)
 
+	if archiveDir := os.Getenv("ARCHIVE_DIR"); archiveDir != "" {
+		qc.SetArchiveDir(archiveDir)
+	}
+
+	// ARCHIVE_FORMAT archives every cleanup unless the command picks a format
+	if archiveFormat := os.Getenv("ARCHIVE_FORMAT"); archiveFormat != "" {
+		if !queue.ValidArchiveFormat(archiveFormat) {
+			logging.Fatal("$ARCHIVE_FORMAT must be one of ndjson, export or html")
+		}
+		defaultCleanupOptions.Archive = archiveFormat
+	}
+
 	clientID := os.Getenv("CLIENT_ID")
 	if clientID == "" {
-		log.Fatal("$CLIENT_ID must be set")
+		logging.Fatal("$CLIENT_ID must be set")
 	}
 
 	clientSecret := os.Getenv("CLIENT_SECRET")
 	if clientSecret == "" {
-		log.Fatal("$CLIENT_SECRET must be set")
+		logging.Fatal("$CLIENT_SECRET must be set")
 	}
 
-	verificationToken := os.Getenv("VERIFICATION_TOKEN")
-	if verificationToken == "" {
-		log.Fatal("$VERIFICATION_TOKEN must be set")
+	signingSecret := os.Getenv("SIGNING_SECRET")
+	if signingSecret == "" {
+		logging.Fatal("$SIGNING_SECRET must be set")
 	}
 
 	redirectURI := os.Getenv("REDIRECT_URI")
 	if redirectURI == "" {
-		log.Fatal("$REDIRECT_URI must be set")
+		logging.Fatal("$REDIRECT_URI must be set")
+	}
+	exporter, err := newAuditExporter(clientSecret, redirectURI)
+	if err != nil {
+		logging.Fatal("Invalid Redirect URI format")
 	}
 
 	// Catch signal so we can shutdown gracefully
-	sigCh := make(chan os.Signal)
+	sigCh := make(chan os.Signal, 1)
 	signal.Notify(sigCh, syscall.SIGTERM, syscall.SIGINT)
 
 	router := gin.New()
-	router.Use(gin.Logger())
-	router.LoadHTMLFiles("static/add_to_slack.html")
+	router.Use(requestLogger())
+	router.LoadHTMLFiles("static/add_to_slack.html", "static/install_error.html")
 
 	router.GET("/", func(c *gin.Context) {
-		c.HTML(http.StatusOK, "add_to_slack.html", nil)
+		state, err := newOAuthState(clientSecret, time.Now())
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		c.SetCookie(oauthStateCookie, state, int(oauthStateTTL/time.Second), "/auth", "", secureRequest(c), true)
+		c.HTML(http.StatusOK, "add_to_slack.html", gin.H{
+			"ClientID": clientID,
+			"State":    state,
+		})
 	})
 
 	router.GET("/auth/redirect", func(c *gin.Context) {
+		if slackError := c.Query("error"); slackError != "" {
+			status, message := installErrorMessage(slackError)
+			installError(c, status, message)
+			return
+		}
+		state := c.Query("state")
+		cookie, _ := c.Cookie(oauthStateCookie)
+		if err := checkOAuthState(clientSecret, state, cookie, time.Now()); err != nil {
+			if err == errOAuthStateBrowser {
+				installError(c, http.StatusForbidden, "This install link was not started from this browser. Please start again.")
+				return
+			}
+			installError(c, http.StatusForbidden, "This install link has expired. Please start again.")
+			return
+		}
+		c.SetCookie(oauthStateCookie, "", -1, "/auth", "", secureRequest(c), true)
 		code := c.Query("code")
+		if code == "" {
+			installError(c, http.StatusBadRequest, "Slack did not send an authorization code. Please start again.")
+			return
+		}
 		response, err := slack.GetOAuthResponse(clientID, clientSecret, code, redirectURI, false)
 		if err != nil {
-			c.Status(http.StatusInternalServerError)
+			slog.Warn("unable to exchange the oauth code", "request_id", logging.RequestID(c.Request.Context()), "error", err)
+			installError(c, http.StatusBadGateway, "Slack rejected the authorization. Please start again.")
+			return
 		}
-		t, err := db.GetTokenDataByUserID(response.UserID)
+		domain, err := teamDomain(response.AccessToken)
+		if err != nil {
+			slog.Warn("unable to look up the team domain", "request_id", logging.RequestID(c.Request.Context()), "error", err)
+		}
+		t, err := db.GetTokenData(response.TeamID, "", response.UserID)
 		if err != nil {
 			if err == backend.ErrRecordNotFound {
 				err = db.CreateTokenData(&backend.TokenData{
 					OAuthResponse: *response,
+					TeamDomain:    domain,
 				})
 				if err != nil {
-					c.Status(http.StatusInternalServerError)
+					installError(c, http.StatusInternalServerError, "The authorization could not be saved. Please try again later.")
 					return
 				}
+				go sendWelcome(response.AccessToken, response.UserID)
 			} else {
-				c.Status(http.StatusInternalServerError)
+				installError(c, http.StatusInternalServerError, "The authorization could not be saved. Please try again later.")
 				return
 			}
 		} else {
 			updated := backend.TokenData{
 				OAuthResponse: *response,
+				TeamDomain:    domain,
 			}
 			updated.ID = t.ID
 			if err := db.UpdateTokenData(&updated); err != nil {
-				c.Status(http.StatusInternalServerError)
+				installError(c, http.StatusInternalServerError, "The authorization could not be saved. Please try again later.")
 				return
 			}
 		}
-		c.Redirect(303, "https://"+response.TeamName+".slack.com")
+		c.Redirect(http.StatusSeeOther, workspaceURL(domain, response.TeamID))
 	})
 
-	router.POST("/slashcommand/tmp", func(c *gin.Context) {
-		slashCommand, err := slack.SlashCommandParse(c.Request)
+	// every request from Slack is signed with the signing secret
+	// /metrics is public facing like every other route, so it is only served
+	// to holders of METRICS_TOKEN
+	if token := os.Getenv("METRICS_TOKEN"); token != "" {
+		router.GET("/metrics", metricsHandler(token))
+	}
+	metrics.RegisterQueue(qc.Backlog)
+
+	router.GET("/audit.csv", func(c *gin.Context) {
+		query, err := exporter.query(c.Request.URL.Query(), time.Now())
+		if err != nil {
+			c.String(http.StatusForbidden, "This export link is invalid or expired, run /clean audit for a new one")
+			return
+		}
+		entries, err := qc.AuditLog(query)
 		if err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		if !slashCommand.ValidateToken(verificationToken) {
+		c.Header("Content-Type", "text/csv")
+		c.Header("Content-Disposition", `attachment; filename="deletion-audit.csv"`)
+		w := csv.NewWriter(c.Writer)
+		w.Write(queue.AuditCSVHeader)
+		for _, e := range entries {
+			w.Write(e.CSVRecord())
+		}
+		w.Flush()
+		if err := w.Error(); err != nil {
+			slog.Error("unable to write the audit export", "request_id", logging.RequestID(c.Request.Context()), "error", err)
+		}
+	})
+
+	slackRequests := router.Group("/", verifySlackRequest(signingSecret))
+
+	slackRequests.POST("/slashcommand/tmp", observeSlashCommand(), func(c *gin.Context) {
+		slashCommand, err := slack.SlashCommandParse(c.Request)
+		if err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		t, err := db.GetTokenDataByUserID(slashCommand.UserID)
+		t, err := lookupToken(db, slashCommand.TeamID, slashCommand.EnterpriseID, slashCommand.UserID)
 		if err != nil {
 			if err == backend.ErrRecordNotFound {
 				c.JSON(http.StatusOK, userNotFoundMessage())
@@ -143,7 +282,7 @@ func main() {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		api := slack.New(t.AccessToken)
+		api := slack.New(t.AccessToken, metrics.SlackClient)
 		params := slack.NewPostMessageParameters()
 		params.AsUser = true
 		params.Username = slashCommand.UserName
@@ -154,24 +293,20 @@ func main() {
 			return
 		}
 		deleteTime := time.Now().Add(defaultDeleteDelay)
-		if err := qc.QueueDelayedDelete(t.AccessToken, slashCommand.ChannelID, ts, deleteTime); err != nil {
+		if err := qc.QueueDelayedDelete(c.Request.Context(), slashCommand.TeamID, t.EnterpriseID, slashCommand.ChannelID, slashCommand.UserID, ts, deleteTime); err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
 		c.Status(http.StatusOK)
 	})
 
-	router.POST("/slashcommand/tmpt", func(c *gin.Context) {
+	slackRequests.POST("/slashcommand/tmpt", observeSlashCommand(), func(c *gin.Context) {
 		slashCommand, err := slack.SlashCommandParse(c.Request)
 		if err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		if !slashCommand.ValidateToken(verificationToken) {
-			c.Status(http.StatusInternalServerError)
-			return
-		}
-		t, err := db.GetTokenDataByUserID(slashCommand.UserID)
+		t, err := lookupToken(db, slashCommand.TeamID, slashCommand.EnterpriseID, slashCommand.UserID)
 		if err != nil {
 			if err == backend.ErrRecordNotFound {
 				c.JSON(http.StatusOK, userNotFoundMessage())
@@ -185,7 +320,7 @@ func main() {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		api := slack.New(t.AccessToken)
+		api := slack.New(t.AccessToken, metrics.SlackClient)
 		params := slack.NewPostMessageParameters()
 		params.AsUser = true
 		params.Username = slashCommand.UserName
@@ -196,24 +331,20 @@ func main() {
 			return
 		}
 		deleteTime := time.Now().Add(delayTime)
-		if err := qc.QueueDelayedDelete(t.AccessToken, slashCommand.ChannelID, ts, deleteTime); err != nil {
+		if err := qc.QueueDelayedDelete(c.Request.Context(), slashCommand.TeamID, t.EnterpriseID, slashCommand.ChannelID, slashCommand.UserID, ts, deleteTime); err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
 		c.Status(http.StatusOK)
 	})
 
-	router.POST("/slashcommand/clean", func(c *gin.Context) {
+	slackRequests.POST("/slashcommand/clean", observeSlashCommand(), func(c *gin.Context) {
 		slashCommand, err := slack.SlashCommandParse(c.Request)
 		if err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		if !slashCommand.ValidateToken(verificationToken) {
-			c.Status(http.StatusInternalServerError)
-			return
-		}
-		t, err := db.GetTokenDataByUserID(slashCommand.UserID)
+		t, err := lookupToken(db, slashCommand.TeamID, slashCommand.EnterpriseID, slashCommand.UserID)
 		if err != nil {
 			if err == backend.ErrRecordNotFound {
 				c.JSON(http.StatusOK, userNotFoundMessage())
@@ -222,23 +353,259 @@ func main() {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
-		opts, err := parseCleanChannelOptions(slashCommand.Text)
+		if strings.TrimSpace(slashCommand.Text) == "status" {
+			jobs, err := qc.UserJobs(slashCommand.TeamID, slashCommand.UserID)
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, statusResponseMessage(jobs))
+			return
+		}
+		if text := strings.TrimSpace(slashCommand.Text); strings.HasPrefix(text+" ", "policy ") {
+			msg, err := policyCommand(db, slashCommand, strings.TrimPrefix(text, "policy"))
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, msg)
+			return
+		}
+		if text := strings.TrimSpace(slashCommand.Text); strings.HasPrefix(text+" ", "audit ") {
+			msg, err := auditCommand(qc, exporter, t.AccessToken, slashCommand, strings.TrimPrefix(text, "audit"))
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, msg)
+			return
+		}
+		if text := strings.TrimSpace(slashCommand.Text); strings.HasPrefix(text+" ", "expire ") {
+			msg, err := expireCommand(db, slashCommand, strings.TrimPrefix(text, "expire"))
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, msg)
+			return
+		}
+		if strings.TrimSpace(slashCommand.Text) == "cancel" {
+			res, err := qc.CancelCleanChannel(slashCommand.UserID, slashCommand.ChannelID, "")
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, cancelResponseMessage(res))
+			return
+		}
+		if strings.TrimSpace(slashCommand.Text) == "" {
+			// the dialog state carries the request ID to the submission
+			requestID := logging.RequestID(c.Request.Context())
+			if err := openDialog(t.AccessToken, slashCommand.TriggerID, cleanDialog(defaultCleanupOptions), requestID); err != nil {
+				slog.Warn("unable to open the clean dialog", "request_id", requestID, "error", err)
+				c.JSON(http.StatusOK, errorResponseMessage("Unable to open the cleanup dialog, use /clean with arguments instead"))
+				return
+			}
+			c.Status(http.StatusOK)
+			return
+		}
+		var grace time.Duration
+		var fields []string
+		for _, field := range splitCommandText(slashCommand.Text) {
+			if strings.HasPrefix(field, "--grace=") {
+				if grace, err = time.ParseDuration(strings.TrimPrefix(field, "--grace=")); err != nil || grace < 0 {
+					c.JSON(http.StatusOK, errorResponseMessage("Invalid --grace, expected a duration like --grace=5m"))
+					return
+				}
+				continue
+			}
+			fields = append(fields, field)
+		}
+		opts, err := parseCleanChannelFields(fields)
 		if err != nil {
-			c.Status(http.StatusInternalServerError)
+			c.JSON(http.StatusOK, errorResponseMessage(err.Error()))
 			return
 		}
-		if err := qc.QueueCleanChannel(t.AccessToken, slashCommand.ChannelID, slashCommand.UserID, opts); err != nil {
+		if !opts.DryRun {
+			msg, err := previewCleanup(c.Request.Context(), db, qc, slashCommand.TeamID, t.EnterpriseID, slashCommand.ChannelID, slashCommand.UserID, slashCommand.ResponseURL, opts, grace)
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, msg)
+			return
+		}
+		if err := qc.QueueCleanChannel(c.Request.Context(), slashCommand.TeamID, t.EnterpriseID, slashCommand.ChannelID, slashCommand.UserID, slashCommand.ResponseURL, "", opts, time.Time{}); err != nil {
 			c.Status(http.StatusInternalServerError)
 			return
 		}
 		c.JSON(http.StatusOK, slack.Msg{
 			ResponseType: "ephemeral",
-			Text:         "Cleanup Request Scheduled",
+			Text:         "Dry Run Scheduled, nothing will be deleted. A summary will follow shortly.",
 		})
 	})
 
+	slackRequests.POST("/interactive", func(c *gin.Context) {
+		var payload interactionPayload
+		if err := json.Unmarshal([]byte(c.PostForm("payload")), &payload); err != nil {
+			c.Status(http.StatusBadRequest)
+			return
+		}
+		name, value := payload.action()
+		switch {
+		case payload.Type == "dialog_submission" && payload.CallbackID == cleanDialogCallback:
+			opts, errs := cleanDialogOptions(payload.Submission)
+			if len(errs) > 0 {
+				c.JSON(http.StatusOK, gin.H{"errors": errs})
+				return
+			}
+			var msg slack.Msg
+			t, err := lookupToken(db, payload.Team.ID, payload.Team.EnterpriseID, payload.User.ID)
+			switch {
+			case err == backend.ErrRecordNotFound:
+				msg = userNotFoundMessage()
+			case err != nil:
+				c.Status(http.StatusInternalServerError)
+				return
+			case opts.DryRun:
+				ctx := originContext(c.Request.Context(), payload.State)
+				if err := qc.QueueCleanChannel(ctx, payload.Team.ID, t.EnterpriseID, payload.Channel.ID, payload.User.ID, payload.ResponseURL, "", opts, time.Time{}); err != nil {
+					c.Status(http.StatusInternalServerError)
+					return
+				}
+				msg = slack.Msg{
+					ResponseType: "ephemeral",
+					Text:         "Dry Run Scheduled, nothing will be deleted. A summary will follow shortly.",
+				}
+			default:
+				ctx := originContext(c.Request.Context(), payload.State)
+				if msg, err = previewCleanup(ctx, db, qc, payload.Team.ID, t.EnterpriseID, payload.Channel.ID, payload.User.ID, payload.ResponseURL, opts, 0); err != nil {
+					c.Status(http.StatusInternalServerError)
+					return
+				}
+			}
+			// dialog submissions cannot carry a message, it follows on the response_url
+			requestID := logging.RequestID(originContext(c.Request.Context(), payload.State))
+			go func() {
+				if err := queue.Respond(payload.ResponseURL, msg); err != nil {
+					slog.Warn("unable to respond to the clean dialog", "request_id", requestID, "error", err)
+				}
+			}()
+			c.Status(http.StatusOK)
+		case payload.CallbackID == queue.ConfirmCleanCallback && name == "cancel":
+			if _, err := db.TakePendingCleanup(value, payload.User.ID, time.Time{}); err != nil && err != backend.ErrRecordNotFound {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, replaceMessage("Cleanup cancelled, nothing was deleted"))
+		case payload.CallbackID == queue.ConfirmCleanCallback && name == "confirm":
+			t, err := lookupToken(db, payload.Team.ID, payload.Team.EnterpriseID, payload.User.ID)
+			if err != nil {
+				if err == backend.ErrRecordNotFound {
+					c.JSON(http.StatusOK, userNotFoundMessage())
+					return
+				}
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			pending, opts, err := takeCleanup(db, value, payload.User.ID)
+			if err == backend.ErrRecordNotFound {
+				c.JSON(http.StatusOK, replaceMessage("This confirmation has expired, run /clean again"))
+				return
+			}
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			grace := time.Duration(pending.GraceSeconds) * time.Second
+			runAt := time.Now().Add(grace)
+			nonce, err := newAbortNonce()
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			ctx := originContext(c.Request.Context(), pending.RequestID)
+			if err := qc.QueueCleanChannel(ctx, pending.TeamID, t.EnterpriseID, pending.Channel, payload.User.ID, payload.ResponseURL, nonce, opts, runAt); err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			c.JSON(http.StatusOK, scheduledCleanMessage(runAt, grace, nonce))
+		case payload.CallbackID == abortCleanCallback:
+			// without a nonce every cleanup in the channel would be cancelled
+			if value == "" {
+				c.JSON(http.StatusOK, replaceMessage("This cleanup can no longer be aborted here, use /clean cancel instead"))
+				return
+			}
+			res, err := qc.CancelCleanChannel(payload.User.ID, payload.Channel.ID, value)
+			if err != nil {
+				c.Status(http.StatusInternalServerError)
+				return
+			}
+			msg := cancelResponseMessage(res)
+			msg.ReplaceOriginal = true
+			c.JSON(http.StatusOK, msg)
+		default:
+			c.Status(http.StatusOK)
+		}
+	})
+
+	dispatcher := events.NewDispatcher(db)
+	dispatcher.HandleMessage(func(ctx context.Context, teamID string, e events.MessageEvent) error {
+		return expireMessage(ctx, db, qc, teamID, e)
+	})
+	dispatcher.HandleFileShared(func(ctx context.Context, teamID string, e events.FileSharedEvent) error {
+		return expireFile(ctx, db, qc, teamID, e)
+	})
+	dispatcher.HandleTokensRevoked(func(ctx context.Context, teamID string, e events.TokensRevokedEvent) error {
+		// only user tokens are stored, bot tokens are never kept
+		if len(e.Tokens.OAuth) == 0 {
+			return nil
+		}
+		return revokeTokens(db, qc, teamID, e.Tokens.OAuth)
+	})
+	dispatcher.HandleAppUninstalled(func(ctx context.Context, teamID string) error {
+		return revokeTokens(db, qc, teamID, nil)
+	})
+	purgeDone := make(chan struct{})
+	go dispatcher.PurgeLoop(purgeDone, time.Hour, 24*time.Hour)
+	defer close(purgeDone)
+
+	// TOKEN_MAX_IDLE purges tokens unused for that long, unset or off keeps them
+	sweeper := &tokenSweeper{db: db, qc: qc}
+	if maxIdle := os.Getenv("TOKEN_MAX_IDLE"); maxIdle != "" && maxIdle != "off" {
+		if sweeper.maxIdle, err = parseTTL(maxIdle); err != nil {
+			logging.Fatal("$TOKEN_MAX_IDLE must be a duration like 90d, or off")
+		}
+	}
+	sweepDone := make(chan struct{})
+	go sweeper.loop(sweepDone, 24*time.Hour, 10*time.Minute)
+	defer close(sweepDone)
+
+	slackRequests.POST("/events", func(c *gin.Context) {
+		body, err := ioutil.ReadAll(c.Request.Body)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		challenge, err := dispatcher.Dispatch(c.Request.Context(), body)
+		if err != nil {
+			c.Status(http.StatusInternalServerError)
+			return
+		}
+		if challenge != "" {
+			c.JSON(http.StatusOK, gin.H{"challenge": challenge})
+			return
+		}
+		c.Status(http.StatusOK)
+	})
+
 	go qc.StartWorkers()
 
+	sched := scheduler.NewScheduler(db, qc, time.Minute)
+	sched.Archive = defaultCleanupOptions.Archive
+	go sched.Start()
+	defer sched.Stop()
+
 	server := &http.Server{
 		Addr:    ":" + port,
 		Handler: router,
@@ -247,20 +614,53 @@ func main() {
 	go func() {
 		// service connections
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Fatalf("Listen Error: %s\n", err)
+			logging.Fatal("Listen Error", "error", err)
 		}
 	}()
 	defer func() {
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 		if err := server.Shutdown(ctx); err != nil {
-			log.Fatal("Server Shutdown:", err)
+			logging.Fatal("Server Shutdown", "error", err)
 		}
 	}()
 
 	// Wait for a signal
 	sig := <-sigCh
-	log.Printf("%s Signal received. Shutting down Application.", sig.String())
+	slog.Info("signal received, shutting down", "signal", sig.String())
+}
+
+// lookupToken finds the token for the workspace a request came from,
+// recording the Enterprise Grid org of the workspace the first time a request
+// from it names one
+func lookupToken(db backend.Database, teamID, enterpriseID, userID string) (*backend.TokenData, error) {
+	t, err := db.GetTokenData(teamID, enterpriseID, userID)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.TouchTokenData(t.ID); err != nil {
+		slog.Warn("unable to record token use", "team_id", teamID, "user_id", userID, "error", err)
+	}
+	if enterpriseID != "" && t.EnterpriseID == "" && t.TeamID == teamID {
+		t.EnterpriseID = enterpriseID
+		if err := db.UpdateTokenData(t); err != nil {
+			return nil, err
+		}
+	}
+	return t, nil
+}
+
+// teamDomain returns the subdomain of the workspace a token belongs to
+func teamDomain(token string) (string, error) {
+	resp, err := slack.New(token, metrics.SlackClient).AuthTest()
+	if err != nil {
+		return "", err
+	}
+	u, err := url.Parse(resp.URL)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(u.Hostname(), ".slack.com"), nil
 }
 
 func userNotFoundMessage() slack.Msg {
@@ -277,6 +677,60 @@ func errorResponseMessage(errorString string) slack.Msg {
 	}
 }
 
+func cancelResponseMessage(res queue.CancelResult) slack.Msg {
+	text := "There is no cleanup to cancel in this channel"
+	if res.Dequeued > 0 || res.Stopping > 0 {
+		text = fmt.Sprintf("Cancelled %d queued cleanup(s), %d running cleanup(s) will stop after their current deletion",
+			res.Dequeued, res.Stopping)
+	}
+	return slack.Msg{
+		Text:         text,
+		ResponseType: "ephemeral",
+	}
+}
+
+func statusResponseMessage(jobs []queue.JobStatus) slack.Msg {
+	if len(jobs) == 0 {
+		return slack.Msg{
+			Text:         "You have no queued or running jobs",
+			ResponseType: "ephemeral",
+		}
+	}
+	lines := make([]string, 0, len(jobs))
+	for _, j := range jobs {
+		name := "Delayed delete"
+		switch j.Type {
+		case queue.CleanChannelJob:
+			name = "Cleanup"
+		case queue.RetentionPolicyJob:
+			name = "Retention policy run"
+		}
+		line := fmt.Sprintf("%s in <#%s>", name, j.Channel)
+		if j.Options != nil {
+			line += " (" + j.Options.String() + ")"
+		}
+		switch {
+		case j.Running:
+			line += ": running"
+		case j.Scheduled():
+			line += ": scheduled for " + j.RunAt.UTC().Format(time.RFC1123)
+		default:
+			line += fmt.Sprintf(": queued at position %d", j.Position)
+		}
+		if !j.EnqueuedAt.IsZero() {
+			line += ", enqueued " + j.EnqueuedAt.UTC().Format(time.RFC1123)
+		}
+		if j.ErrorCount > 0 {
+			line += fmt.Sprintf(", %d failed attempt(s), last error: %s", j.ErrorCount, j.LastError)
+		}
+		lines = append(lines, line)
+	}
+	return slack.Msg{
+		Text:         strings.Join(lines, "\n"),
+		ResponseType: "ephemeral",
+	}
+}
+
 func parseTextForTimeout(rawText string) (string, time.Duration, error) {
 	text := strings.Split(rawText, " ")
 	minutes, err := strconv.Atoi(text[len(text)-1])
@@ -291,13 +745,33 @@ func parseTextForTimeout(rawText string) (string, time.Duration, error) {
 }
 
 func parseCleanChannelOptions(rawText string) (queue.CleanChannelOpts, error) {
-	if rawText == "" {
-		return defaultCleanupOptions, nil
+	return parseCleanChannelFields(splitCommandText(rawText))
+}
+
+// parseCleanChannelFields parses the positional booleans and flags of an
+// already split /clean command
+func parseCleanChannelFields(fields []string) (queue.CleanChannelOpts, error) {
+	opts := defaultCleanupOptions
+	var text []string
+	for _, field := range fields {
+		if !strings.HasPrefix(field, "--") {
+			text = append(text, field)
+			continue
+		}
+		if err := parseCleanChannelFlag(&opts, field); err != nil {
+			return queue.CleanChannelOpts{}, err
+		}
+	}
+	if opts.Since != "" && opts.Until != "" && opts.Since > opts.Until {
+		return queue.CleanChannelOpts{}, fmt.Errorf("Invalid Request, --since must not be after --until")
 	}
-	text := strings.Split(rawText, " ")
 	if len(text) == 0 {
-		// using defaults
-		return defaultCleanupOptions, nil
+		// using defaults, --keep-last only spares the user's own messages
+		// and leaves thread replies alone
+		if opts.KeepLast > 0 {
+			opts.Files, opts.Bots, opts.SkipThreads = false, false, true
+		}
+		return opts, nil
 	}
 	if len(text) != 3 {
 		return queue.CleanChannelOpts{}, fmt.Errorf("Invalid Request")
@@ -314,9 +788,104 @@ func parseCleanChannelOptions(rawText string) (queue.CleanChannelOpts, error) {
 	if err != nil {
 		return queue.CleanChannelOpts{}, fmt.Errorf("Invalid Request")
 	}
-	return queue.CleanChannelOpts{
-		Messages: delMsgs,
-		Files:    delFiles,
-		Bots:     delBotMsgs,
-	}, nil
+	if opts.KeepLast > 0 && (delFiles || delBotMsgs) {
+		return queue.CleanChannelOpts{}, fmt.Errorf("Invalid Request, --keep-last only keeps your own messages and cannot be combined with files or bots")
+	}
+	opts.Messages = delMsgs
+	opts.Files = delFiles
+	opts.Bots = delBotMsgs
+	if opts.KeepLast > 0 {
+		opts.SkipThreads = true
+	}
+	return opts, nil
+}
+
+// parseCleanChannelFlag applies a single --flag or --flag=value to opts
+func parseCleanChannelFlag(opts *queue.CleanChannelOpts, field string) error {
+	name, value := field, ""
+	if i := strings.Index(field, "="); i >= 0 {
+		name, value = field[:i], field[i+1:]
+	}
+	switch name {
+	case "--dry-run":
+		opts.DryRun = true
+	case "--skip-threads":
+		opts.SkipThreads = true
+	case "--older-than":
+		days, err := strconv.Atoi(strings.TrimSuffix(value, "d"))
+		if err != nil || days <= 0 {
+			return fmt.Errorf("Invalid --older-than, expected a number of days like --older-than=30")
+		}
+		opts.OlderThanDays = days
+	case "--since":
+		if _, err := time.Parse(queue.DateLayout, value); err != nil {
+			return fmt.Errorf("Invalid --since, expected a date like --since=2018-12-01")
+		}
+		opts.Since = value
+	case "--until":
+		if _, err := time.Parse(queue.DateLayout, value); err != nil {
+			return fmt.Errorf("Invalid --until, expected a date like --until=2018-12-31")
+		}
+		opts.Until = value
+	case "--keep-last":
+		keep, err := strconv.Atoi(value)
+		if err != nil || keep <= 0 {
+			return fmt.Errorf("Invalid --keep-last, expected a number of messages like --keep-last=100")
+		}
+		opts.KeepLast = keep
+	case "--archive":
+		if !queue.ValidArchiveFormat(value) {
+			return fmt.Errorf("Invalid --archive, expected one of ndjson, export or html")
+		}
+		opts.Archive = value
+	case "--match", "--exclude":
+		if value == "" {
+			return fmt.Errorf("Invalid %s, expected a keyword like %s=deploy", name, name)
+		}
+		if name == "--match" {
+			opts.Keywords = append(opts.Keywords, value)
+		} else {
+			opts.ExcludeKeywords = append(opts.ExcludeKeywords, value)
+		}
+	case "--regex", "--exclude-regex":
+		if _, err := regexp.Compile(value); err != nil || value == "" {
+			return fmt.Errorf("Invalid %s, expected a regular expression like %s=\"https?://\"", name, name)
+		}
+		if name == "--regex" {
+			opts.Pattern = value
+		} else {
+			opts.ExcludePattern = value
+		}
+	default:
+		return fmt.Errorf("Unknown option %s", name)
+	}
+	return nil
+}
+
+// splitCommandText splits slash command text on whitespace, keeping double
+// quoted runs together. Slack may turn straight quotes into curly ones.
+func splitCommandText(rawText string) []string {
+	var fields []string
+	var field strings.Builder
+	inQuotes, inField := false, false
+	for _, r := range rawText {
+		switch {
+		case r == '"' || r == '“' || r == '”':
+			inQuotes = !inQuotes
+			inField = true
+		case unicode.IsSpace(r) && !inQuotes:
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+	if inField {
+		fields = append(fields, field.String())
+	}
+	return fields
 }
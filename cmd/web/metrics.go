@@ -0,0 +1,58 @@
+package main
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// cleanSubcommands are reported as commands of their own, any other text
+// counts as a cleanup
+var cleanSubcommands = map[string]bool{
+	"status": true,
+	"cancel": true,
+	"policy": true,
+	"expire": true,
+	"audit":  true,
+}
+
+// observeSlashCommand is middleware counting slash commands by name and
+// outcome once the handler answered
+func observeSlashCommand() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		c.Next()
+		command := c.Request.PostFormValue("command")
+		if command == "" {
+			command = "unknown"
+		}
+		if fields := strings.Fields(c.Request.PostFormValue("text")); len(fields) > 0 && cleanSubcommands[fields[0]] {
+			command += " " + fields[0]
+		}
+		outcome := "ok"
+		switch status := c.Writer.Status(); {
+		case status >= 500:
+			outcome = "error"
+		case status >= 400:
+			outcome = "rejected"
+		}
+		metrics.ObserveSlashCommand(command, outcome, time.Since(start))
+	}
+}
+
+// metricsHandler serves the Prometheus metrics behind a bearer token
+func metricsHandler(token string) gin.HandlerFunc {
+	handler := promhttp.Handler()
+	return func(c *gin.Context) {
+		if subtle.ConstantTimeCompare([]byte(c.GetHeader("Authorization")), []byte("Bearer "+token)) != 1 {
+			c.AbortWithStatus(http.StatusUnauthorized)
+			return
+		}
+		handler.ServeHTTP(c.Writer, c.Request)
+	}
+}
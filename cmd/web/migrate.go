@@ -0,0 +1,93 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/king-jam/channel-cleaner/migrations"
+)
+
+// migrationTargets returns the Postgres databases the app uses: the
+// DATABASE_URL and QUEUE_URL ones unless they select another backend
+func migrationTargets() []string {
+	var targets []string
+	if dbString := os.Getenv("DATABASE_URL"); isPostgres(dbString) {
+		targets = append(targets, dbString)
+	}
+	if queueString := os.Getenv("QUEUE_URL"); isPostgres(queueString) && queueString != os.Getenv("DATABASE_URL") {
+		targets = append(targets, queueString)
+	}
+	return targets
+}
+
+// isPostgres reports whether a database URL points at Postgres
+func isPostgres(dbString string) bool {
+	u, err := url.Parse(dbString)
+	return err == nil && (u.Scheme == "postgres" || u.Scheme == "postgresql")
+}
+
+// migrate implements the migrate subcommand: `web migrate` applies the
+// pending migrations and `web migrate status` lists every migration
+func migrate(args []string) {
+	targets := migrationTargets()
+	if len(targets) == 0 {
+		logging.Fatal("$DATABASE_URL or $QUEUE_URL must point at Postgres")
+	}
+	if len(args) > 0 && args[0] != "status" {
+		logging.Fatal("unknown migrate command, expected no argument or status", "command", args[0])
+	}
+	for _, target := range targets {
+		if len(args) > 0 {
+			if err := printMigrations(target); err != nil {
+				logging.Fatal("Unable to read migrations", "error", err)
+			}
+			continue
+		}
+		if err := runMigrations(target); err != nil {
+			logging.Fatal("Unable to migrate the Database", "error", err)
+		}
+	}
+}
+
+// printMigrations lists every migration and whether it was applied
+func printMigrations(dbString string) error {
+	db, err := sql.Open("postgres", dbString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	all, err := migrations.Status(db)
+	if err != nil {
+		return err
+	}
+	if u, err := url.Parse(dbString); err == nil {
+		fmt.Printf("%s%s\n", u.Host, u.Path)
+	}
+	for _, m := range all {
+		state := "pending"
+		if !m.AppliedAt.IsZero() {
+			state = "applied " + m.AppliedAt.Format("2006-01-02 15:04:05 MST")
+		}
+		fmt.Printf("%04d %-40s %s\n", m.Version, m.Name, state)
+	}
+	return nil
+}
+
+// runMigrations applies pending migrations. The app runs them on startup
+// too, so deploys without a release phase get the current schema.
+func runMigrations(dbString string) error {
+	db, err := sql.Open("postgres", dbString)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	applied, err := migrations.Run(db)
+	for _, m := range applied {
+		slog.Info("applied migration", "version", m.Version, "name", m.Name)
+	}
+	return err
+}
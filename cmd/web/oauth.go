@@ -0,0 +1,122 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/nlopes/slack"
+)
+
+const (
+	// oauthStateCookie ties the state handed to Slack to the browser that
+	// started the install
+	oauthStateCookie = "oauth_state"
+	// oauthStateTTL is how long an install can take
+	oauthStateTTL = 10 * time.Minute
+)
+
+// newOAuthState issues a nonce that expires after oauthStateTTL, signed with
+// secret so it cannot be forged: nonce.expiry.signature
+func newOAuthState(secret string, now time.Time) (string, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	payload := hex.EncodeToString(nonce) + "." + strconv.FormatInt(now.Add(oauthStateTTL).Unix(), 10)
+	return payload + "." + signOAuthState(secret, payload), nil
+}
+
+// errOAuthStateBrowser rejects a state returned to another browser than the
+// one it was issued to, or returned a second time after its cookie was cleared
+var errOAuthStateBrowser = errors.New("state not issued to this browser")
+
+// checkOAuthState accepts the state Slack returned only from the browser
+// holding it in its cookie and only while it is valid
+func checkOAuthState(secret, state, cookie string, now time.Time) error {
+	if state == "" || cookie != state {
+		return errOAuthStateBrowser
+	}
+	return verifyOAuthState(secret, state, now)
+}
+
+// verifyOAuthState checks the signature and expiry of a state
+func verifyOAuthState(secret, state string, now time.Time) error {
+	i := strings.LastIndex(state, ".")
+	if i < 0 {
+		return errors.New("malformed state")
+	}
+	payload, signature := state[:i], state[i+1:]
+	if !hmac.Equal([]byte(signature), []byte(signOAuthState(secret, payload))) {
+		return errors.New("state signature mismatch")
+	}
+	parts := strings.Split(payload, ".")
+	if len(parts) != 2 {
+		return errors.New("malformed state")
+	}
+	expiry, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil {
+		return errors.New("malformed state")
+	}
+	if now.Unix() > expiry {
+		return errors.New("state expired")
+	}
+	return nil
+}
+
+func signOAuthState(secret, payload string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(payload))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// secureRequest reports whether the browser reached the app over https,
+// directly or through the Heroku router
+func secureRequest(c *gin.Context) bool {
+	return c.Request.TLS != nil || c.GetHeader("X-Forwarded-Proto") == "https"
+}
+
+// installError renders the error page of the install flow
+func installError(c *gin.Context, status int, message string) {
+	c.HTML(status, "install_error.html", gin.H{
+		"Message": message,
+	})
+}
+
+// workspaceURL is where the browser goes after a successful install
+func workspaceURL(domain, teamID string) string {
+	if domain != "" {
+		return "https://" + domain + ".slack.com"
+	}
+	return "https://slack.com/app_redirect?team=" + teamID
+}
+
+// sendWelcome posts a getting started message to the direct message
+// conversation of a user who installed the app for the first time
+func sendWelcome(token, userID string) {
+	api := slack.New(token, metrics.SlackClient)
+	params := slack.NewPostMessageParameters()
+	params.AsUser = true
+	text := fmt.Sprintf("Thanks for installing! Try `/clean --dry-run` in any channel to see what a cleanup would delete, or just `/clean` to pick what to delete. Run `/clean status` to follow your cleanups. Manage the app at %s", deployedURL)
+	if _, _, err := api.PostMessage(userID, text, params); err != nil {
+		slog.Warn("unable to send the welcome message", "user_id", userID, "error", err)
+	}
+}
+
+// installErrorMessage explains the error Slack sent back instead of a code
+func installErrorMessage(slackError string) (int, string) {
+	if slackError == "access_denied" {
+		return http.StatusOK, "The app was not installed because the request was cancelled."
+	}
+	return http.StatusBadRequest, "Slack could not complete the install: " + slackError
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+const testClientSecret = "client-secret"
+
+func TestCheckOAuthState(t *testing.T) {
+	issued := time.Unix(1546300800, 0)
+	state, err := newOAuthState(testClientSecret, issued)
+	if err != nil {
+		t.Fatalf("newOAuthState: %v", err)
+	}
+	other, err := newOAuthState(testClientSecret, issued)
+	if err != nil {
+		t.Fatalf("newOAuthState: %v", err)
+	}
+	if state == other {
+		t.Fatal("newOAuthState issued the same state twice")
+	}
+	parts := strings.Split(state, ".")
+	extended := parts[0] + "." + "9999999999" + "." + parts[2]
+	tampered := state[:len(state)-1] + "0"
+	if strings.HasSuffix(state, "0") {
+		tampered = state[:len(state)-1] + "1"
+	}
+	tests := []struct {
+		name    string
+		secret  string
+		state   string
+		cookie  string
+		now     time.Time
+		wantErr string
+	}{
+		{"valid", testClientSecret, state, state, issued.Add(time.Minute), ""},
+		{"valid until expiry", testClientSecret, state, state, issued.Add(oauthStateTTL), ""},
+		{"expired", testClientSecret, state, state, issued.Add(oauthStateTTL + time.Second), "state expired"},
+		{"tampered signature", testClientSecret, tampered, tampered, issued, "state signature mismatch"},
+		{"extended expiry", testClientSecret, extended, extended, issued, "state signature mismatch"},
+		{"other secret", "another secret", state, state, issued, "state signature mismatch"},
+		{"forged", testClientSecret, "nonce.9999999999.signature", "nonce.9999999999.signature", issued, "state signature mismatch"},
+		{"malformed", testClientSecret, "state", "state", issued, "malformed state"},
+		{"replayed after the cookie was cleared", testClientSecret, state, "", issued, errOAuthStateBrowser.Error()},
+		{"replayed from another browser", testClientSecret, state, other, issued, errOAuthStateBrowser.Error()},
+		{"missing state", testClientSecret, "", "", issued, errOAuthStateBrowser.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := checkOAuthState(tt.secret, tt.state, tt.cookie, tt.now)
+			switch {
+			case tt.wantErr == "" && err != nil:
+				t.Errorf("checkOAuthState() = %v, want nil", err)
+			case tt.wantErr != "" && (err == nil || err.Error() != tt.wantErr):
+				t.Errorf("checkOAuthState() = %v, want %s", err, tt.wantErr)
+			}
+		})
+	}
+}
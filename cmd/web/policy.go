@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/queue"
+	"github.com/king-jam/channel-cleaner/scheduler"
+	"github.com/nlopes/slack"
+)
+
+var policyUsage = "Usage: /clean policy add [messages files bots] --older-than=N|--keep-last=N [--schedule=\"0 3 * * *\"], /clean policy list or /clean policy remove ID"
+
+// policyCommand handles the /clean policy subcommands
+func policyCommand(db backend.Database, slashCommand slack.SlashCommand, rawText string) (slack.Msg, error) {
+	fields := strings.Fields(rawText)
+	if len(fields) == 0 {
+		return errorResponseMessage(policyUsage), nil
+	}
+	switch fields[0] {
+	case "add":
+		return addPolicy(db, slashCommand, strings.TrimSpace(strings.TrimPrefix(rawText, "add")))
+	case "list":
+		policies, err := db.GetRetentionPoliciesByUserID(slashCommand.UserID)
+		if err != nil {
+			return slack.Msg{}, err
+		}
+		return policyListMessage(policies), nil
+	case "remove":
+		if len(fields) != 2 {
+			return errorResponseMessage(policyUsage), nil
+		}
+		id, err := strconv.ParseUint(fields[1], 10, 32)
+		if err != nil {
+			return errorResponseMessage(policyUsage), nil
+		}
+		if err := db.DeleteRetentionPolicy(slashCommand.UserID, uint(id)); err != nil {
+			if err == backend.ErrRecordNotFound {
+				return errorResponseMessage(fmt.Sprintf("You have no retention policy %d", id)), nil
+			}
+			return slack.Msg{}, err
+		}
+		return errorResponseMessage(fmt.Sprintf("Removed retention policy %d", id)), nil
+	}
+	return errorResponseMessage(policyUsage), nil
+}
+
+func addPolicy(db backend.Database, slashCommand slack.SlashCommand, rawText string) (slack.Msg, error) {
+	schedule := scheduler.DefaultSchedule
+	var rest []string
+	for _, field := range splitCommandText(rawText) {
+		if strings.HasPrefix(field, "--schedule=") {
+			schedule = strings.TrimPrefix(field, "--schedule=")
+			continue
+		}
+		rest = append(rest, field)
+	}
+	opts, err := parseCleanChannelFields(rest)
+	if err != nil {
+		return errorResponseMessage(err.Error()), nil
+	}
+	if opts.OlderThanDays == 0 && opts.KeepLast == 0 {
+		return errorResponseMessage("A retention policy needs --older-than or --keep-last"), nil
+	}
+	if opts.DryRun || opts.Since != "" || opts.Until != "" || opts.SkipThreads || opts.Pattern != "" ||
+		opts.ExcludePattern != "" || len(opts.Keywords) > 0 || len(opts.ExcludeKeywords) > 0 {
+		return errorResponseMessage("Retention policies only support --older-than, --keep-last and --schedule"), nil
+	}
+	next, err := scheduler.NextRun(schedule, time.Now())
+	if err != nil || next.IsZero() {
+		return errorResponseMessage("Invalid --schedule, expected a cron expression like --schedule=\"0 3 * * *\" or @daily"), nil
+	}
+	p := backend.RetentionPolicy{
+		UserID:        slashCommand.UserID,
+		TeamID:        slashCommand.TeamID,
+		EnterpriseID:  slashCommand.EnterpriseID,
+		ChannelID:     slashCommand.ChannelID,
+		Schedule:      schedule,
+		Messages:      opts.Messages,
+		Files:         opts.Files,
+		Bots:          opts.Bots,
+		OlderThanDays: opts.OlderThanDays,
+		KeepLast:      opts.KeepLast,
+		NextRunAt:     next,
+	}
+	if err := db.CreateRetentionPolicy(&p); err != nil {
+		return slack.Msg{}, err
+	}
+	return errorResponseMessage(fmt.Sprintf("Added retention policy %d: %s, first run %s",
+		p.ID, describePolicy(p), next.Format(time.RFC1123))), nil
+}
+
+func describePolicy(p backend.RetentionPolicy) string {
+	opts := queue.CleanChannelOpts{
+		Messages:      p.Messages,
+		Files:         p.Files,
+		Bots:          p.Bots,
+		OlderThanDays: p.OlderThanDays,
+		KeepLast:      p.KeepLast,
+	}
+	return fmt.Sprintf("<#%s> %s on %q", p.ChannelID, opts.String(), p.Schedule)
+}
+
+func policyListMessage(policies []backend.RetentionPolicy) slack.Msg {
+	if len(policies) == 0 {
+		return errorResponseMessage("You have no retention policies")
+	}
+	lines := make([]string, 0, len(policies))
+	for _, p := range policies {
+		lines = append(lines, fmt.Sprintf("%d: %s, next run %s", p.ID, describePolicy(p), p.NextRunAt.UTC().Format(time.RFC1123)))
+	}
+	return errorResponseMessage(strings.Join(lines, "\n"))
+}
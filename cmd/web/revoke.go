@@ -0,0 +1,90 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/queue"
+)
+
+// tokenSweepTask names the token sweep in the shared task runs
+const tokenSweepTask = "token_sweep"
+
+// revokeTokens purges the tokens of users of a workspace and cancels their
+// jobs, or those of the whole workspace when userIDs is empty
+func revokeTokens(db backend.Database, qc queue.Queue, teamID string, userIDs []string) error {
+	purged, err := db.DeleteTokenData(teamID, userIDs)
+	if err != nil {
+		return err
+	}
+	cancelled, err := qc.CancelRevokedJobs(teamID, userIDs)
+	if err != nil {
+		return err
+	}
+	slog.Info("tokens revoked", "team_id", teamID, "users", len(userIDs), "purged", purged, "cancelled_jobs", cancelled)
+	return nil
+}
+
+// tokenSweeper purges tokens Slack no longer accepts and, when maxIdle is
+// set, tokens unused for longer than maxIdle
+type tokenSweeper struct {
+	db      backend.Database
+	qc      queue.Queue
+	maxIdle time.Duration
+}
+
+// loop sweeps once every interval until done is closed. It checks right away
+// and then every check whether the interval passed since the last sweep of
+// any process, so restarts neither skip nor repeat a sweep.
+func (s *tokenSweeper) loop(done <-chan struct{}, interval, check time.Duration) {
+	ticker := time.NewTicker(check)
+	defer ticker.Stop()
+	now := time.Now()
+	for {
+		claimed, err := s.db.ClaimTaskRun(tokenSweepTask, now, now.Add(-interval))
+		if err != nil {
+			slog.Warn("unable to claim the token sweep", "error", err)
+		} else if claimed {
+			if err := s.sweep(now); err != nil {
+				slog.Error("unable to sweep tokens", "error", err)
+			}
+		}
+		select {
+		case <-done:
+			return
+		case now = <-ticker.C:
+		}
+	}
+}
+
+func (s *tokenSweeper) sweep(now time.Time) error {
+	if s.maxIdle > 0 {
+		unused, err := s.db.GetUnusedTokenData(now.Add(-s.maxIdle))
+		if err != nil {
+			return err
+		}
+		for _, t := range unused {
+			if err := revokeTokens(s.db, s.qc, t.TeamID, []string{t.UserID}); err != nil {
+				return err
+			}
+		}
+	}
+	tokens, err := s.db.GetAllTokenData()
+	if err != nil {
+		return err
+	}
+	for _, t := range tokens {
+		err := s.qc.TestToken(t.AccessToken, t.TeamID)
+		if !queue.TokenRevoked(err) {
+			if err != nil {
+				slog.Warn("unable to test the token", "team_id", t.TeamID, "user_id", t.UserID, "error", err)
+			}
+			continue
+		}
+		if err := revokeTokens(s.db, s.qc, t.TeamID, []string{t.UserID}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
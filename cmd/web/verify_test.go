@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const testSigningSecret = "8f742231b10e8888abcd99yyyzzz85a5"
+
+// slackSignature signs a request body the way Slack does
+func slackSignature(secret, timestamp, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte("v0:" + timestamp + ":" + body))
+	return "v0=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestVerifySlackRequest(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	const body = "token=x&team_id=T1&command=%2Fclean&text=true+false+false"
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-maxRequestAge-time.Minute).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(maxRequestAge+time.Minute).Unix(), 10)
+	tests := []struct {
+		name      string
+		timestamp string
+		signature string
+		body      string
+		want      int
+	}{
+		{"valid", now, slackSignature(testSigningSecret, now, body), body, http.StatusOK},
+		{"expired", old, slackSignature(testSigningSecret, old, body), body, http.StatusUnauthorized},
+		{"from the future", future, slackSignature(testSigningSecret, future, body), body, http.StatusUnauthorized},
+		{"replayed with a new timestamp", now, slackSignature(testSigningSecret, old, body), body, http.StatusUnauthorized},
+		{"tampered body", now, slackSignature(testSigningSecret, now, body), body + "+true", http.StatusUnauthorized},
+		{"wrong secret", now, slackSignature("another secret", now, body), body, http.StatusUnauthorized},
+		{"malformed signature", now, "v0=zz", body, http.StatusUnauthorized},
+		{"missing signature", now, "", body, http.StatusUnauthorized},
+		{"missing timestamp", "", slackSignature(testSigningSecret, now, body), body, http.StatusUnauthorized},
+		{"malformed timestamp", "yesterday", slackSignature(testSigningSecret, "yesterday", body), body, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var received string
+			router := gin.New()
+			router.POST("/slack", verifySlackRequest(testSigningSecret), func(c *gin.Context) {
+				b, _ := ioutil.ReadAll(c.Request.Body)
+				received = string(b)
+				c.Status(http.StatusOK)
+			})
+			req := httptest.NewRequest(http.MethodPost, "/slack", strings.NewReader(tt.body))
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			if tt.timestamp != "" {
+				req.Header.Set("X-Slack-Request-Timestamp", tt.timestamp)
+			}
+			if tt.signature != "" {
+				req.Header.Set("X-Slack-Signature", tt.signature)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, req)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && received != tt.body {
+				t.Errorf("handler read body %q, want %q", received, tt.body)
+			}
+		})
+	}
+}
@@ -0,0 +1,146 @@
+package events
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/logging"
+)
+
+// Deduper records handled event IDs. Slack retries a delivery it did not
+// get a timely answer for, possibly to another dyno.
+type Deduper interface {
+	// MarkEventProcessed records the event and reports whether it is new
+	MarkEventProcessed(eventID string) (bool, error)
+	// UnmarkEventProcessed forgets an event whose handler failed so the
+	// retry is handled
+	UnmarkEventProcessed(eventID string) error
+	// PurgeProcessedEvents forgets events recorded before the given time
+	PurgeProcessedEvents(before time.Time) error
+}
+
+// Handler handles one type of event
+type Handler func(ctx context.Context, e Envelope) error
+
+// Dispatcher answers url_verification and routes deduplicated event
+// callbacks to the handler registered for their type
+type Dispatcher struct {
+	dedupe   Deduper
+	handlers map[string]Handler
+}
+
+// NewDispatcher creates a dispatcher without handlers
+func NewDispatcher(dedupe Deduper) *Dispatcher {
+	return &Dispatcher{
+		dedupe:   dedupe,
+		handlers: make(map[string]Handler),
+	}
+}
+
+// Handle registers the handler for an event type
+func (d *Dispatcher) Handle(eventType string, h Handler) {
+	d.handlers[eventType] = h
+}
+
+// HandleMessage registers a handler for message events
+func (d *Dispatcher) HandleMessage(h func(ctx context.Context, teamID string, e MessageEvent) error) {
+	d.Handle(Message, func(ctx context.Context, env Envelope) error {
+		var e MessageEvent
+		if err := json.Unmarshal(env.Event, &e); err != nil {
+			return err
+		}
+		return h(ctx, env.TeamID, e)
+	})
+}
+
+// HandleFileShared registers a handler for file_shared events
+func (d *Dispatcher) HandleFileShared(h func(ctx context.Context, teamID string, e FileSharedEvent) error) {
+	d.Handle(FileShared, func(ctx context.Context, env Envelope) error {
+		var e FileSharedEvent
+		if err := json.Unmarshal(env.Event, &e); err != nil {
+			return err
+		}
+		return h(ctx, env.TeamID, e)
+	})
+}
+
+// HandleTokensRevoked registers a handler for tokens_revoked events
+func (d *Dispatcher) HandleTokensRevoked(h func(ctx context.Context, teamID string, e TokensRevokedEvent) error) {
+	d.Handle(TokensRevoked, func(ctx context.Context, env Envelope) error {
+		var e TokensRevokedEvent
+		if err := json.Unmarshal(env.Event, &e); err != nil {
+			return err
+		}
+		return h(ctx, env.TeamID, e)
+	})
+}
+
+// HandleAppUninstalled registers a handler for app_uninstalled events
+func (d *Dispatcher) HandleAppUninstalled(h func(ctx context.Context, teamID string) error) {
+	d.Handle(AppUninstalled, func(ctx context.Context, env Envelope) error {
+		return h(ctx, env.TeamID)
+	})
+}
+
+// Dispatch handles a verified Events API request body, returning the
+// challenge for url_verification requests. The context is handed to the
+// handler.
+func (d *Dispatcher) Dispatch(ctx context.Context, body []byte) (string, error) {
+	env, err := Parse(body)
+	if err != nil {
+		return "", err
+	}
+	switch env.Type {
+	case URLVerification:
+		return env.Challenge, nil
+	case EventCallback:
+	default:
+		// app_rate_limited and future envelope types need no answer
+		return "", nil
+	}
+	eventType, err := env.EventType()
+	if err != nil {
+		return "", err
+	}
+	h, ok := d.handlers[eventType]
+	if !ok {
+		return "", nil
+	}
+	if env.EventID != "" {
+		fresh, err := d.dedupe.MarkEventProcessed(env.EventID)
+		if err != nil {
+			return "", err
+		}
+		if !fresh {
+			return "", nil
+		}
+	}
+	if err := h(ctx, env); err != nil {
+		if env.EventID != "" {
+			if uerr := d.dedupe.UnmarkEventProcessed(env.EventID); uerr != nil {
+				slog.Warn("unable to unmark the event", "request_id", logging.RequestID(ctx), "event_id", env.EventID, "error", uerr)
+			}
+		}
+		return "", err
+	}
+	return "", nil
+}
+
+// PurgeLoop forgets processed events older than retention every interval
+// until done is closed
+func (d *Dispatcher) PurgeLoop(done <-chan struct{}, interval, retention time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case now := <-ticker.C:
+			if err := d.dedupe.PurgeProcessedEvents(now.Add(-retention)); err != nil {
+				slog.Warn("unable to purge processed events", "error", err)
+			}
+		}
+	}
+}
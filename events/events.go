@@ -0,0 +1,83 @@
+package events
+
+import (
+	"encoding/json"
+)
+
+const (
+	// URLVerification is sent once when the request URL is configured
+	URLVerification = "url_verification"
+	// EventCallback wraps every subscribed event
+	EventCallback = "event_callback"
+
+	// Message is posted for new messages in subscribed conversations
+	Message = "message"
+	// FileShared is posted when a file is shared
+	FileShared = "file_shared"
+	// TokensRevoked is posted when users revoke the tokens they granted
+	TokensRevoked = "tokens_revoked"
+	// AppUninstalled is posted when the app is removed from a workspace
+	AppUninstalled = "app_uninstalled"
+)
+
+// Envelope is the outer payload Slack posts to the Events API request URL
+type Envelope struct {
+	Token     string          `json:"token"`
+	TeamID    string          `json:"team_id"`
+	APIAppID  string          `json:"api_app_id"`
+	Type      string          `json:"type"`
+	Challenge string          `json:"challenge"`
+	EventID   string          `json:"event_id"`
+	EventTime int64           `json:"event_time"`
+	Event     json.RawMessage `json:"event"`
+}
+
+// inner is the part every event shares
+type inner struct {
+	Type string `json:"type"`
+}
+
+// MessageEvent is a message posted to a channel
+type MessageEvent struct {
+	Type            string `json:"type"`
+	SubType         string `json:"subtype"`
+	Channel         string `json:"channel"`
+	User            string `json:"user"`
+	Text            string `json:"text"`
+	Timestamp       string `json:"ts"`
+	ThreadTimestamp string `json:"thread_ts"`
+}
+
+// FileSharedEvent is a file shared by a user
+type FileSharedEvent struct {
+	Type      string `json:"type"`
+	FileID    string `json:"file_id"`
+	UserID    string `json:"user_id"`
+	ChannelID string `json:"channel_id"`
+	EventTS   string `json:"event_ts"`
+}
+
+// TokensRevokedEvent lists the users and bots whose tokens were revoked
+type TokensRevokedEvent struct {
+	Type   string `json:"type"`
+	Tokens struct {
+		OAuth []string `json:"oauth"`
+		Bot   []string `json:"bot"`
+	} `json:"tokens"`
+}
+
+// Parse decodes an Events API request body
+func Parse(body []byte) (Envelope, error) {
+	var e Envelope
+	err := json.Unmarshal(body, &e)
+	return e, err
+}
+
+// EventType returns the type of the wrapped event
+func (e Envelope) EventType() (string, error) {
+	var i inner
+	if err := json.Unmarshal(e.Event, &i); err != nil {
+		return "", err
+	}
+	return i.Type, nil
+}
@@ -0,0 +1,122 @@
+// Package metrics defines the Prometheus metrics of the cleaner
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const namespace = "channel_cleaner"
+
+var (
+	slashCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slash_commands_total",
+		Help:      "Slash commands handled by command and outcome.",
+	}, []string{"command", "outcome"})
+
+	slashCommandDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "slash_command_duration_seconds",
+		Help:      "Time spent answering slash commands.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"command"})
+
+	jobsEnqueued = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_enqueued_total",
+		Help:      "Jobs enqueued by type.",
+	}, []string{"type"})
+
+	jobsCompleted = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_completed_total",
+		Help:      "Job runs that succeeded by type.",
+	}, []string{"type"})
+
+	jobsFailed = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "jobs_failed_total",
+		Help:      "Job runs that failed and will be retried by type.",
+	}, []string{"type"})
+
+	jobDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "job_duration_seconds",
+		Help:      "Time spent running jobs by type.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 15, 60, 300, 900, 3600},
+	}, []string{"type"})
+
+	slackCalls = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "slack_api_calls_total",
+		Help:      "Slack Web API calls by method and HTTP status, error when no response arrived.",
+	}, []string{"method", "status"})
+
+	deletions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "deletions_total",
+		Help:      "Messages and files the jobs tried to delete by kind and outcome.",
+	}, []string{"kind", "outcome"})
+)
+
+func init() {
+	prometheus.MustRegister(slashCommands, slashCommandDuration, jobsEnqueued, jobsCompleted,
+		jobsFailed, jobDuration, slackCalls, deletions)
+}
+
+// ObserveSlashCommand records a handled slash command
+func ObserveSlashCommand(command, outcome string, took time.Duration) {
+	slashCommands.WithLabelValues(command, outcome).Inc()
+	slashCommandDuration.WithLabelValues(command).Observe(took.Seconds())
+}
+
+// JobEnqueued records an enqueued job
+func JobEnqueued(jobType string) {
+	jobsEnqueued.WithLabelValues(jobType).Inc()
+}
+
+// ObserveJob records a finished job run
+func ObserveJob(jobType string, took time.Duration, err error) {
+	if err != nil {
+		jobsFailed.WithLabelValues(jobType).Inc()
+	} else {
+		jobsCompleted.WithLabelValues(jobType).Inc()
+	}
+	jobDuration.WithLabelValues(jobType).Observe(took.Seconds())
+}
+
+// Deletion records a delete attempted by a job, kind being message or file
+func Deletion(kind, outcome string) {
+	deletions.WithLabelValues(kind, outcome).Inc()
+}
+
+// SlackHTTPClient counts the Slack API calls made through it
+var SlackHTTPClient = &http.Client{
+	Transport: slackTransport{http.DefaultTransport},
+}
+
+// SlackClient is the slack.New option that counts the calls of the client
+var SlackClient = slack.OptionHTTPClient(SlackHTTPClient)
+
+// slackTransport counts Slack API calls, taking the method from the
+// https://slack.com/api/<method> URL
+type slackTransport struct {
+	next http.RoundTripper
+}
+
+func (t slackTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	method := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+	resp, err := t.next.RoundTrip(req)
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+	slackCalls.WithLabelValues(method, status).Inc()
+	return resp, err
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import (
+	"log"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Backlog describes the jobs of one type waiting in the queue
+type Backlog struct {
+	Type  string
+	Depth int
+	// OldestDue is how long the oldest job that is due has been waiting
+	OldestDue time.Duration
+}
+
+var (
+	queueDepthDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "queue", "depth"),
+		"Jobs in the queue by type, scheduled and running ones included.", []string{"type"}, nil)
+	queueAgeDesc = prometheus.NewDesc(prometheus.BuildFQName(namespace, "queue", "oldest_due_job_age_seconds"),
+		"How long the oldest due job of each type has been waiting.", []string{"type"}, nil)
+)
+
+// queueCollector reads the backlog from the queue at scrape time
+type queueCollector struct {
+	backlog func() ([]Backlog, error)
+}
+
+// RegisterQueue exposes the backlog returned by the function
+func RegisterQueue(backlog func() ([]Backlog, error)) {
+	prometheus.MustRegister(queueCollector{backlog})
+}
+
+func (c queueCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- queueDepthDesc
+	ch <- queueAgeDesc
+}
+
+func (c queueCollector) Collect(ch chan<- prometheus.Metric) {
+	backlog, err := c.backlog()
+	if err != nil {
+		log.Printf("attempting to read the queue backlog: %v", err)
+		ch <- prometheus.NewInvalidMetric(queueDepthDesc, err)
+		return
+	}
+	for _, b := range backlog {
+		ch <- prometheus.MustNewConstMetric(queueDepthDesc, prometheus.GaugeValue, float64(b.Depth), b.Type)
+		ch <- prometheus.MustNewConstMetric(queueAgeDesc, prometheus.GaugeValue, b.OldestDue.Seconds(), b.Type)
+	}
+}
@@ -0,0 +1,225 @@
+package migrations
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq" // registers the postgres driver
+	"github.com/pkg/errors"
+)
+
+// files holds the migrations, named NNNN_description.sql and applied in
+// version order: the Postgres ones under sql and the ones of the SQLite
+// database of the in-process queue under sqlite. Migrations are never edited
+// once released, schema changes go in a new file. Statements use IF NOT
+// EXISTS so databases created before migrations existed are adopted as is.
+//
+//go:embed sql/*.sql sqlite/*.sql
+var files embed.FS
+
+// lockKey serializes migration runs across dynos. que locks jobs by their
+// id, a key this large never collides with one.
+const lockKey = 7883956907566396721
+
+const (
+	sqlCreateSchemaMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+  version    integer     NOT NULL PRIMARY KEY,
+  name       text        NOT NULL,
+  applied_at timestamptz NOT NULL DEFAULT now()
+)`
+
+	sqlCreateSQLiteSchemaMigrations = `
+CREATE TABLE IF NOT EXISTS schema_migrations
+(
+  version    integer   NOT NULL PRIMARY KEY,
+  name       text      NOT NULL,
+  applied_at timestamp NOT NULL DEFAULT CURRENT_TIMESTAMP
+)`
+
+	sqlAppliedMigrations = `
+SELECT version, applied_at FROM schema_migrations`
+
+	sqlRecordMigration = `
+INSERT INTO schema_migrations (version, name) VALUES ($1, $2)`
+)
+
+// dialect holds what differs between the databases migrations run on
+type dialect struct {
+	dir                    string
+	createSchemaMigrations string
+}
+
+var (
+	postgres = dialect{"sql", sqlCreateSchemaMigrations}
+	sqlite   = dialect{"sqlite", sqlCreateSQLiteSchemaMigrations}
+)
+
+// Migration is a single versioned schema change
+type Migration struct {
+	Version int
+	Name    string
+	SQL     string
+	// AppliedAt is zero for pending migrations
+	AppliedAt time.Time
+}
+
+// Load returns the embedded Postgres migrations in version order
+func Load() ([]Migration, error) {
+	return load(postgres.dir)
+}
+
+func load(dir string) ([]Migration, error) {
+	entries, err := files.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var migrations []Migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		name := strings.TrimSuffix(entry.Name(), ".sql")
+		i := strings.Index(name, "_")
+		if i < 0 {
+			return nil, fmt.Errorf("migration %s is not named NNNN_description.sql", entry.Name())
+		}
+		version, err := strconv.Atoi(name[:i])
+		if err != nil {
+			return nil, fmt.Errorf("migration %s is not named NNNN_description.sql", entry.Name())
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s share version %d", other, entry.Name(), version)
+		}
+		seen[version] = entry.Name()
+		body, err := files.ReadFile(path.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, Migration{
+			Version: version,
+			Name:    name[i+1:],
+			SQL:     string(body),
+		})
+	}
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Status returns every migration with the time it was applied, if it was
+func Status(db *sql.DB) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, sqlCreateSchemaMigrations); err != nil {
+		return nil, errors.Wrap(err, "Unable to create schema_migrations")
+	}
+	return status(ctx, conn, postgres)
+}
+
+// Run applies the pending migrations, each in its own transaction, and
+// returns the ones it applied
+func Run(db *sql.DB) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", int64(lockKey)); err != nil {
+		return nil, errors.Wrap(err, "Unable to lock migrations")
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", int64(lockKey))
+
+	return run(ctx, conn, postgres)
+}
+
+// RunSQLite applies the pending migrations of the SQLite database of the
+// in-process queue. It is used by a single process, so unlike Run it takes
+// no lock.
+func RunSQLite(db *sql.DB) ([]Migration, error) {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return run(ctx, conn, sqlite)
+}
+
+func run(ctx context.Context, conn *sql.Conn, d dialect) ([]Migration, error) {
+	if _, err := conn.ExecContext(ctx, d.createSchemaMigrations); err != nil {
+		return nil, errors.Wrap(err, "Unable to create schema_migrations")
+	}
+	all, err := status(ctx, conn, d)
+	if err != nil {
+		return nil, err
+	}
+	var applied []Migration
+	for _, m := range all {
+		if !m.AppliedAt.IsZero() {
+			continue
+		}
+		if err := apply(ctx, conn, m); err != nil {
+			return applied, errors.Wrapf(err, "Unable to apply migration %04d_%s", m.Version, m.Name)
+		}
+		m.AppliedAt = time.Now()
+		applied = append(applied, m)
+	}
+	return applied, nil
+}
+
+func status(ctx context.Context, conn *sql.Conn, d dialect) ([]Migration, error) {
+	migrations, err := load(d.dir)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := conn.QueryContext(ctx, sqlAppliedMigrations)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	appliedAt := make(map[int]time.Time)
+	for rows.Next() {
+		var version int
+		var at time.Time
+		if err := rows.Scan(&version, &at); err != nil {
+			return nil, err
+		}
+		appliedAt[version] = at
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	for i := range migrations {
+		migrations[i].AppliedAt = appliedAt[migrations[i].Version]
+	}
+	return migrations, nil
+}
+
+func apply(ctx context.Context, conn *sql.Conn, m Migration) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(ctx, m.SQL); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, sqlRecordMigration, m.Version, m.Name); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,18 @@
+CREATE TABLE IF NOT EXISTS token_data
+(
+  id           serial,
+  created_at   timestamptz,
+  updated_at   timestamptz,
+  deleted_at   timestamptz,
+  access_token text,
+  scope        text,
+  team_name    text,
+  team_id      text,
+  user_id      text,
+  ok           boolean,
+  error        text,
+
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_token_data_deleted_at ON token_data (deleted_at);
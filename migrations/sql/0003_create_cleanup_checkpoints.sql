@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS cleanup_checkpoints
+(
+  job_id         bigint      NOT NULL PRIMARY KEY,
+  history_latest text        NOT NULL DEFAULT '',
+  messages_done  boolean     NOT NULL DEFAULT false,
+  file_page      integer     NOT NULL DEFAULT 1,
+  worker         text        NOT NULL DEFAULT '',
+  heartbeat_at   timestamptz NOT NULL DEFAULT now()
+);
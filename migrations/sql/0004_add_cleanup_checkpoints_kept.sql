@@ -0,0 +1 @@
+ALTER TABLE cleanup_checkpoints ADD COLUMN IF NOT EXISTS kept integer NOT NULL DEFAULT 0;
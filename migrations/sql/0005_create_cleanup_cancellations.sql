@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS cleanup_cancellations
+(
+  job_id           bigint      NOT NULL PRIMARY KEY,
+  user_id          text        NOT NULL,
+  channel_id       text        NOT NULL,
+  requested_at     timestamptz NOT NULL DEFAULT now(),
+  stopped_at       timestamptz,
+  history_latest   text        NOT NULL DEFAULT '',
+  deleted_messages integer     NOT NULL DEFAULT 0,
+  deleted_files    integer     NOT NULL DEFAULT 0
+);
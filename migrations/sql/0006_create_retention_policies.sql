@@ -0,0 +1,23 @@
+CREATE TABLE IF NOT EXISTS retention_policies
+(
+  id              serial,
+  created_at      timestamptz,
+  updated_at      timestamptz,
+  deleted_at      timestamptz,
+  user_id         text,
+  team_id         text,
+  channel_id      text,
+  schedule        text,
+  messages        boolean,
+  files           boolean,
+  bots            boolean,
+  older_than_days integer,
+  keep_last       integer,
+  next_run_at     timestamptz,
+
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_retention_policies_deleted_at ON retention_policies (deleted_at);
+CREATE INDEX IF NOT EXISTS idx_retention_policies_user_id ON retention_policies (user_id);
+CREATE INDEX IF NOT EXISTS idx_retention_policies_next_run_at ON retention_policies (next_run_at);
@@ -0,0 +1,16 @@
+CREATE TABLE IF NOT EXISTS auto_expires
+(
+  id          serial,
+  created_at  timestamptz,
+  updated_at  timestamptz,
+  deleted_at  timestamptz,
+  user_id     text,
+  team_id     text,
+  channel_id  text,
+  ttl_seconds integer,
+
+  PRIMARY KEY (id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_auto_expires_deleted_at ON auto_expires (deleted_at);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_auto_expire_user_channel ON auto_expires (user_id, channel_id);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS processed_events
+(
+  event_id   text,
+  created_at timestamptz,
+
+  PRIMARY KEY (event_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_processed_events_created_at ON processed_events (created_at);
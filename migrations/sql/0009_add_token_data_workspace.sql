@@ -0,0 +1,8 @@
+-- tokens are keyed by workspace and user instead of user alone
+ALTER TABLE token_data ADD COLUMN IF NOT EXISTS team_domain text;
+ALTER TABLE token_data ADD COLUMN IF NOT EXISTS enterprise_id text;
+CREATE INDEX IF NOT EXISTS idx_token_data_enterprise_id ON token_data (enterprise_id);
+CREATE UNIQUE INDEX IF NOT EXISTS idx_token_data_team_user ON token_data (team_id, user_id);
+
+ALTER TABLE retention_policies ADD COLUMN IF NOT EXISTS enterprise_id text;
+ALTER TABLE auto_expires ADD COLUMN IF NOT EXISTS enterprise_id text;
@@ -0,0 +1 @@
+ALTER TABLE token_data ADD COLUMN IF NOT EXISTS last_used_at timestamptz;
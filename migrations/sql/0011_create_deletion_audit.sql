@@ -0,0 +1,17 @@
+CREATE TABLE IF NOT EXISTS deletion_audit
+(
+  id           bigserial   NOT NULL PRIMARY KEY,
+  team_id      text        NOT NULL,
+  user_id      text        NOT NULL,
+  channel_id   text        NOT NULL,
+  message_ts   text        NOT NULL DEFAULT '',
+  file_id      text        NOT NULL DEFAULT '',
+  category     text        NOT NULL,
+  content_hash text        NOT NULL DEFAULT '',
+  job_id       bigint      NOT NULL,
+  outcome      text        NOT NULL,
+  slack_error  text        NOT NULL DEFAULT '',
+  attempted_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE INDEX IF NOT EXISTS idx_deletion_audit_team_attempted_at ON deletion_audit (team_id, attempted_at);
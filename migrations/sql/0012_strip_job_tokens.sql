@@ -0,0 +1,27 @@
+-- jobs look their token up when they run. Jobs enqueued before tokens were
+-- keyed by workspace carry no team, so take it from the token of their user
+-- first, preferring the token the job holds, or they would be dropped as
+-- revoked.
+UPDATE que_jobs j
+SET args = (j.args::jsonb || (
+  SELECT jsonb_build_object('team_id', t.team_id, 'enterprise_id', coalesce(t.enterprise_id, ''))
+  FROM token_data t
+  WHERE t.user_id = j.args->>'user_id'
+    AND t.deleted_at IS NULL
+  ORDER BY coalesce(t.access_token = j.args->>'token', false) DESC, t.updated_at DESC
+  LIMIT 1
+))::json
+WHERE json_typeof(j.args) = 'object'
+  AND coalesce(j.args->>'team_id', '') = ''
+  AND EXISTS (
+    SELECT 1
+    FROM token_data t
+    WHERE t.user_id = j.args->>'user_id'
+      AND t.deleted_at IS NULL
+  );
+
+-- then drop the tokens
+UPDATE que_jobs
+SET args = (args::jsonb - 'token')::json
+WHERE json_typeof(args) = 'object'
+  AND args::jsonb ? 'token';
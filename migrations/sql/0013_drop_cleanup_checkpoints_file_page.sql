@@ -0,0 +1 @@
+ALTER TABLE cleanup_checkpoints DROP COLUMN IF EXISTS file_page;
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS task_runs
+(
+  name   text,
+  ran_at timestamptz NOT NULL,
+
+  PRIMARY KEY (name)
+);
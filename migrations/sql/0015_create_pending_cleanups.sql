@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS pending_cleanups
+(
+  nonce         text,
+  team_id       text,
+  user_id       text,
+  channel       text,
+  options       text,
+  grace_seconds integer,
+  request_id    text,
+  created_at    timestamptz,
+
+  PRIMARY KEY (nonce)
+);
+
+CREATE INDEX IF NOT EXISTS idx_pending_cleanups_created_at ON pending_cleanups (created_at);
@@ -0,0 +1,3 @@
+ALTER TABLE cleanup_checkpoints ADD COLUMN IF NOT EXISTS scanned_messages integer NOT NULL DEFAULT 0;
+ALTER TABLE cleanup_checkpoints ADD COLUMN IF NOT EXISTS deleted_messages integer NOT NULL DEFAULT 0;
+ALTER TABLE cleanup_checkpoints ADD COLUMN IF NOT EXISTS deleted_files integer NOT NULL DEFAULT 0;
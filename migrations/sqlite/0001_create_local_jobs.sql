@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS local_jobs
+(
+  job_id      integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  job_class   text    NOT NULL,
+  args        text    NOT NULL,
+  run_at      integer NOT NULL,
+  error_count integer NOT NULL DEFAULT 0,
+  last_error  text    NOT NULL DEFAULT '',
+  running     boolean NOT NULL DEFAULT false
+);
@@ -0,0 +1,7 @@
+CREATE TABLE IF NOT EXISTS local_checkpoints
+(
+  job_id         integer NOT NULL PRIMARY KEY,
+  history_latest text    NOT NULL DEFAULT '',
+  messages_done  boolean NOT NULL DEFAULT false,
+  kept           integer NOT NULL DEFAULT 0
+);
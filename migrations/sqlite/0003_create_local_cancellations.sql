@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS local_cancellations
+(
+  job_id           integer NOT NULL PRIMARY KEY,
+  user_id          text    NOT NULL,
+  channel_id       text    NOT NULL,
+  requested_at     integer NOT NULL,
+  stopped_at       integer,
+  history_latest   text    NOT NULL DEFAULT '',
+  deleted_messages integer NOT NULL DEFAULT 0,
+  deleted_files    integer NOT NULL DEFAULT 0
+);
@@ -0,0 +1,15 @@
+CREATE TABLE IF NOT EXISTS local_deletion_audit
+(
+  id           integer NOT NULL PRIMARY KEY AUTOINCREMENT,
+  team_id      text    NOT NULL,
+  user_id      text    NOT NULL,
+  channel_id   text    NOT NULL,
+  message_ts   text    NOT NULL DEFAULT '',
+  file_id      text    NOT NULL DEFAULT '',
+  category     text    NOT NULL,
+  content_hash text    NOT NULL DEFAULT '',
+  job_id       integer NOT NULL,
+  outcome      text    NOT NULL,
+  slack_error  text    NOT NULL DEFAULT '',
+  attempted_at integer NOT NULL
+);
@@ -0,0 +1,4 @@
+-- jobs look their token up when they run, jobs enqueued before that still
+-- hold one
+UPDATE local_jobs SET args = json_remove(args, '$.token')
+WHERE json_extract(args, '$.token') IS NOT NULL;
@@ -0,0 +1,2 @@
+ALTER TABLE local_checkpoints ADD COLUMN worker text NOT NULL DEFAULT '';
+ALTER TABLE local_checkpoints ADD COLUMN heartbeat_at integer NOT NULL DEFAULT 0;
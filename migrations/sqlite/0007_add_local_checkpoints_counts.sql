@@ -0,0 +1,3 @@
+ALTER TABLE local_checkpoints ADD COLUMN scanned_messages integer NOT NULL DEFAULT 0;
+ALTER TABLE local_checkpoints ADD COLUMN deleted_messages integer NOT NULL DEFAULT 0;
+ALTER TABLE local_checkpoints ADD COLUMN deleted_files integer NOT NULL DEFAULT 0;
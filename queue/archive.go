@@ -0,0 +1,232 @@
+package queue
+
+import (
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// ArchiveNDJSON writes one JSON record per deleted item
+	ArchiveNDJSON = "ndjson"
+	// ArchiveSlackExport writes the day files layout of a Slack export
+	ArchiveSlackExport = "export"
+	// ArchiveHTML renders a browsable transcript
+	ArchiveHTML = "html"
+)
+
+// journalName is the NDJSON file every archive appends to. The export and
+// HTML layouts are rendered from it so a resumed job extends its archive.
+const journalName = "items.ndjson"
+
+// Archiver receives every message and file a cleanup is about to delete.
+// Blocks are not exposed by the vendored slack client and are not archived.
+type Archiver interface {
+	ArchiveMessage(m slack.Message, category string) error
+	ArchiveFile(f slack.File) error
+	// Close flushes the archive and returns where it was written
+	Close() (string, error)
+}
+
+// archiveFormats maps the Archive option onto sink constructors
+var archiveFormats = map[string]func(dir, channel string) (Archiver, error){
+	ArchiveNDJSON:      newNDJSONArchiver,
+	ArchiveSlackExport: newExportArchiver,
+	ArchiveHTML:        newHTMLArchiver,
+}
+
+// ValidArchiveFormat reports whether format names a known archive sink
+func ValidArchiveFormat(format string) bool {
+	_, ok := archiveFormats[format]
+	return ok
+}
+
+// archiveDir is where the archive of a job is kept. It is derived from the
+// job so retries of the same job append to the same archive.
+func archiveDir(root string, jobID int64, req CleanChannelRequest) string {
+	return filepath.Join(root, req.TeamID, req.UserID, req.Channel, strconv.FormatInt(jobID, 10))
+}
+
+// newArchiver opens the sink selected by the request options
+func newArchiver(root string, jobID int64, req CleanChannelRequest) (Archiver, error) {
+	newSink, ok := archiveFormats[req.Options.Archive]
+	if !ok {
+		return nil, fmt.Errorf("unknown archive format %q", req.Options.Archive)
+	}
+	dir := archiveDir(root, jobID, req)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return newSink(dir, req.Channel)
+}
+
+// archiveUpload prepares a closed archive for files.upload. Single file
+// archives are uploaded as they are, directories are zipped first.
+func archiveUpload(path string, jobID int64, req CleanChannelRequest) (slack.FileUploadParameters, error) {
+	name := fmt.Sprintf("cleanup-%s-%d", req.Channel, jobID)
+	params := slack.FileUploadParameters{
+		Title: fmt.Sprintf("Archive of the cleanup of #%s (job %d)", req.Channel, jobID),
+	}
+	info, err := os.Stat(path)
+	if err != nil {
+		return params, err
+	}
+	if !info.IsDir() {
+		params.File = path
+		params.Filename = name + filepath.Ext(path)
+		return params, nil
+	}
+	zipPath := path + ".zip"
+	if err := zipDir(path, zipPath); err != nil {
+		return params, err
+	}
+	params.File = zipPath
+	params.Filename = name + ".zip"
+	return params, nil
+}
+
+// zipDir writes every file below dir into a zip archive at dst
+func zipDir(dir, dst string) error {
+	out, err := os.OpenFile(dst, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	zw := zip.NewWriter(out)
+	err = filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+		w, err := zw.Create(filepath.ToSlash(rel))
+		if err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(w, f)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	if err := zw.Close(); err != nil {
+		return err
+	}
+	return out.Close()
+}
+
+// archiveRecord is a single line of the journal
+type archiveRecord struct {
+	Kind       string         `json:"kind"`
+	Category   string         `json:"category"`
+	Channel    string         `json:"channel"`
+	ArchivedAt time.Time      `json:"archived_at"`
+	Message    *slack.Message `json:"message,omitempty"`
+	File       *slack.File    `json:"file,omitempty"`
+}
+
+// ndjsonArchiver appends records to the journal, syncing every write so an
+// item is on disk before it is deleted
+type ndjsonArchiver struct {
+	dir     string
+	channel string
+	f       *os.File
+}
+
+func newNDJSONArchiver(dir, channel string) (Archiver, error) {
+	return openJournal(dir, channel)
+}
+
+func openJournal(dir, channel string) (*ndjsonArchiver, error) {
+	f, err := os.OpenFile(filepath.Join(dir, journalName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &ndjsonArchiver{
+		dir:     dir,
+		channel: channel,
+		f:       f,
+	}, nil
+}
+
+func (a *ndjsonArchiver) write(r archiveRecord) error {
+	r.Channel = a.channel
+	r.ArchivedAt = time.Now()
+	line, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	if _, err := a.f.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return a.f.Sync()
+}
+
+// ArchiveMessage appends a message record
+func (a *ndjsonArchiver) ArchiveMessage(m slack.Message, category string) error {
+	return a.write(archiveRecord{Kind: "message", Category: category, Message: &m})
+}
+
+// ArchiveFile appends a file record
+func (a *ndjsonArchiver) ArchiveFile(f slack.File) error {
+	return a.write(archiveRecord{Kind: "file", Category: CategoryFile, File: &f})
+}
+
+// Close closes the journal
+func (a *ndjsonArchiver) Close() (string, error) {
+	return filepath.Join(a.dir, journalName), a.f.Close()
+}
+
+// readJournal loads every record of the journal in dir, oldest item first
+func readJournal(dir string) ([]archiveRecord, error) {
+	f, err := os.Open(filepath.Join(dir, journalName))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var records []archiveRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var r archiveRecord
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			return nil, err
+		}
+		records = append(records, r)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(records, func(i, j int) bool {
+		return records[i].postedAt().Before(records[j].postedAt())
+	})
+	return records, nil
+}
+
+// postedAt is when the archived item was posted
+func (r archiveRecord) postedAt() time.Time {
+	if r.Message != nil {
+		t, _ := parseTimestamp(r.Message.Timestamp)
+		return t
+	}
+	if r.File != nil {
+		return r.File.Created.Time()
+	}
+	return time.Time{}
+}
@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nlopes/slack"
+)
+
+// exportArchiver lays the journal out like a Slack workspace export: a
+// channels.json index and a folder per channel holding one JSON array of
+// messages per day. Files that were not attached to an archived message are
+// listed in files.json.
+type exportArchiver struct {
+	*ndjsonArchiver
+}
+
+func newExportArchiver(dir, channel string) (Archiver, error) {
+	journal, err := openJournal(dir, channel)
+	if err != nil {
+		return nil, err
+	}
+	return &exportArchiver{journal}, nil
+}
+
+// Close closes the journal and renders the export from it
+func (a *exportArchiver) Close() (string, error) {
+	if _, err := a.ndjsonArchiver.Close(); err != nil {
+		return "", err
+	}
+	records, err := readJournal(a.dir)
+	if err != nil {
+		return "", err
+	}
+	channelDir := filepath.Join(a.dir, a.channel)
+	if err := os.MkdirAll(channelDir, 0700); err != nil {
+		return "", err
+	}
+	days := make(map[string][]slack.Message)
+	files := []slack.File{}
+	for _, r := range records {
+		switch {
+		case r.Message != nil:
+			day := r.postedAt().UTC().Format(DateLayout)
+			days[day] = append(days[day], *r.Message)
+		case r.File != nil:
+			files = append(files, *r.File)
+		}
+	}
+	for day, msgs := range days {
+		if err := writeJSON(filepath.Join(channelDir, day+".json"), msgs); err != nil {
+			return "", err
+		}
+	}
+	if err := writeJSON(filepath.Join(a.dir, "files.json"), files); err != nil {
+		return "", err
+	}
+	channels := []map[string]string{{"id": a.channel, "name": a.channel}}
+	if err := writeJSON(filepath.Join(a.dir, "channels.json"), channels); err != nil {
+		return "", err
+	}
+	return a.dir, nil
+}
+
+func writeJSON(path string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "    ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0600)
+}
@@ -0,0 +1,100 @@
+package queue
+
+import (
+	"html/template"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var transcriptTemplate = template.Must(template.New("transcript").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Archive of {{.Channel}}</title>
+<style>
+body { font-family: sans-serif; max-width: 50em; margin: 2em auto; }
+.item { border-bottom: 1px solid #ddd; padding: 0.5em 0; }
+.meta { color: #666; font-size: 0.85em; }
+.reply { margin-left: 2em; }
+pre { white-space: pre-wrap; margin: 0.25em 0; }
+</style>
+</head>
+<body>
+<h1>Archive of {{.Channel}}</h1>
+{{range .Records}}<div class="item{{if .Reply}} reply{{end}}">
+<div class="meta">{{.PostedAt.UTC.Format "2006-01-02 15:04:05 MST"}} &middot; {{.Category}}{{if .Author}} &middot; {{.Author}}{{end}}</div>
+{{with .Record.Message}}<pre>{{.Text}}</pre>
+{{range .Attachments}}<pre>{{.Pretext}} {{.Title}} {{.Text}}</pre>
+{{end}}{{if .Reactions}}<div class="meta">{{range .Reactions}}:{{.Name}}: {{.Count}} {{end}}</div>
+{{end}}{{end}}{{with .Record.File}}<pre>{{.Name}} ({{.PrettyType}}, {{.Size}} bytes) {{.Title}}</pre>
+{{end}}</div>
+{{end}}</body>
+</html>
+`))
+
+// transcriptItem is a journal record prepared for the transcript template
+type transcriptItem struct {
+	Record archiveRecord
+}
+
+// PostedAt is when the item was posted
+func (i transcriptItem) PostedAt() time.Time { return i.Record.postedAt() }
+
+// Category is own, bot or file
+func (i transcriptItem) Category() string { return i.Record.Category }
+
+// Reply reports whether the item is a thread reply
+func (i transcriptItem) Reply() bool {
+	return i.Record.Message != nil && isThreadReply(*i.Record.Message)
+}
+
+// Author is the user or bot that posted the item
+func (i transcriptItem) Author() string {
+	if m := i.Record.Message; m != nil {
+		if m.User != "" {
+			return m.User
+		}
+		return m.Username
+	}
+	return i.Record.File.User
+}
+
+// htmlArchiver renders the journal as a single page transcript
+type htmlArchiver struct {
+	*ndjsonArchiver
+}
+
+func newHTMLArchiver(dir, channel string) (Archiver, error) {
+	journal, err := openJournal(dir, channel)
+	if err != nil {
+		return nil, err
+	}
+	return &htmlArchiver{journal}, nil
+}
+
+// Close closes the journal and renders the transcript from it
+func (a *htmlArchiver) Close() (string, error) {
+	if _, err := a.ndjsonArchiver.Close(); err != nil {
+		return "", err
+	}
+	records, err := readJournal(a.dir)
+	if err != nil {
+		return "", err
+	}
+	items := make([]transcriptItem, len(records))
+	for i, r := range records {
+		items[i] = transcriptItem{r}
+	}
+	path := filepath.Join(a.dir, "transcript.html")
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0600)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	err = transcriptTemplate.Execute(f, struct {
+		Channel string
+		Records []transcriptItem
+	}{a.channel, items})
+	return path, err
+}
@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx"
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/nlopes/slack"
+	"github.com/pkg/errors"
+)
+
+const (
+	// OutcomeDeleted marks an item Slack deleted
+	OutcomeDeleted = "deleted"
+	// OutcomeAlreadyGone marks an item that no longer existed
+	OutcomeAlreadyGone = "already_gone"
+	// OutcomeFailed marks a delete Slack refused, the job retries it
+	OutcomeFailed = "failed"
+)
+
+const (
+	sqlRecordDeletion = `
+INSERT INTO deletion_audit
+  (team_id, user_id, channel_id, message_ts, file_id, category, content_hash, job_id, outcome, slack_error, attempted_at)
+VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)`
+
+	sqlAuditLog = `
+SELECT id, team_id, user_id, channel_id, message_ts, file_id, category, content_hash, job_id, outcome, slack_error, attempted_at
+FROM deletion_audit
+WHERE team_id = $1
+  AND ($2 = '' OR user_id = $2)
+  AND ($3 = '' OR channel_id = $3)
+  AND attempted_at >= $4
+ORDER BY attempted_at DESC, id DESC
+LIMIT NULLIF($5, 0)`
+)
+
+// AuditEntry is one deletion attempted by a cleanup, retention or delayed
+// delete job
+type AuditEntry struct {
+	ID      int64
+	TeamID  string
+	UserID  string
+	Channel string
+	// Timestamp is set for messages and FileID for files
+	Timestamp string
+	FileID    string
+	Category  string
+	// ContentHash is the hex sha256 of the message text or the file name,
+	// empty when the job never saw the content
+	ContentHash string
+	JobID       int64
+	Outcome     string
+	SlackError  string
+	AttemptedAt time.Time
+}
+
+// AuditQuery selects the audit entries of a workspace, optionally narrowed
+// to a user, a channel and a start time. A zero Limit returns every entry.
+type AuditQuery struct {
+	TeamID  string
+	UserID  string
+	Channel string
+	Since   time.Time
+	Limit   int
+}
+
+// auditLog stores the audit entries next to the jobs
+type auditLog interface {
+	record(e AuditEntry) error
+}
+
+// recordDeletion completes an entry with the outcome of the delete call and
+// stores it. The deletion is not acknowledged until it is recorded, so a
+// failure to record fails the job.
+func recordDeletion(a auditLog, e AuditEntry, deleteErr error) error {
+	switch {
+	case deleteErr == nil:
+		e.Outcome = OutcomeDeleted
+	case alreadyGone(deleteErr):
+		e.Outcome = OutcomeAlreadyGone
+		e.SlackError = deleteErr.Error()
+	default:
+		e.Outcome = OutcomeFailed
+		e.SlackError = firstLine(deleteErr.Error())
+	}
+	e.AttemptedAt = time.Now()
+	kind := "message"
+	if e.FileID != "" {
+		kind = "file"
+	}
+	metrics.Deletion(kind, e.Outcome)
+	if err := a.record(e); err != nil {
+		return errors.Wrap(err, "Unable to record the deletion in the audit log")
+	}
+	return nil
+}
+
+// messageAudit starts the audit entry of a message deleted by a cleanup
+func (c *channelCleaner) messageAudit(m slack.Message, category string) AuditEntry {
+	return AuditEntry{
+		TeamID:      c.req.TeamID,
+		UserID:      c.req.UserID,
+		Channel:     c.req.Channel,
+		Timestamp:   m.Timestamp,
+		Category:    category,
+		ContentHash: contentHash(m.Text),
+		JobID:       c.jobID,
+	}
+}
+
+// fileAudit starts the audit entry of a file deleted by a cleanup
+func (c *channelCleaner) fileAudit(f slack.File) AuditEntry {
+	return AuditEntry{
+		TeamID:      c.req.TeamID,
+		UserID:      c.req.UserID,
+		Channel:     c.req.Channel,
+		FileID:      f.ID,
+		Category:    CategoryFile,
+		ContentHash: contentHash(f.Name),
+		JobID:       c.jobID,
+	}
+}
+
+func contentHash(content string) string {
+	if content == "" {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(content))
+	return hex.EncodeToString(sum[:])
+}
+
+// CSVRecord renders the entry as a row under AuditCSVHeader
+func (e AuditEntry) CSVRecord() []string {
+	return []string{
+		e.AttemptedAt.UTC().Format(time.RFC3339),
+		e.TeamID,
+		e.UserID,
+		e.Channel,
+		e.Timestamp,
+		e.FileID,
+		e.Category,
+		e.ContentHash,
+		strconv.FormatInt(e.JobID, 10),
+		e.Outcome,
+		e.SlackError,
+	}
+}
+
+// AuditCSVHeader names the columns of AuditEntry.CSVRecord
+var AuditCSVHeader = []string{
+	"attempted_at", "team_id", "user_id", "channel_id", "message_ts", "file_id",
+	"category", "content_hash", "job_id", "outcome", "slack_error",
+}
+
+// pgAuditLog keeps the audit entries in the deletion_audit table
+type pgAuditLog struct {
+	pool *pgx.ConnPool
+}
+
+func (a pgAuditLog) record(e AuditEntry) error {
+	_, err := a.pool.Exec(sqlRecordDeletion, e.TeamID, e.UserID, e.Channel, e.Timestamp, e.FileID,
+		e.Category, e.ContentHash, e.JobID, e.Outcome, e.SlackError, e.AttemptedAt)
+	return err
+}
+
+// AuditLog returns the audit entries matching the query, newest first
+func (q *PGQueue) AuditLog(query AuditQuery) ([]AuditEntry, error) {
+	rows, err := q.pgxpool.Query(sqlAuditLog, query.TeamID, query.UserID, query.Channel, query.Since, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		if err := rows.Scan(&e.ID, &e.TeamID, &e.UserID, &e.Channel, &e.Timestamp, &e.FileID, &e.Category,
+			&e.ContentHash, &e.JobID, &e.Outcome, &e.SlackError, &e.AttemptedAt); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
@@ -0,0 +1,140 @@
+package queue
+
+import (
+	"errors"
+	"time"
+)
+
+// errCleanupCancelled aborts a running cleanup whose cancellation was
+// requested
+var errCleanupCancelled = errors.New("cleanup cancelled")
+
+// cancelCheckInterval throttles how often a running cleanup looks for a
+// cancellation request
+var cancelCheckInterval = 5 * time.Second
+
+const (
+	// sqlLockedJobs selects the ids of the jobs que workers are running. que
+	// locks a job with pg_try_advisory_lock on its bigint id, which pg_locks
+	// splits into classid and objid and marks with objsubid 1. Locks taken in
+	// other databases of the server are listed too.
+	sqlLockedJobs = `
+SELECT (classid::bigint << 32) | objid::bigint
+FROM pg_locks
+WHERE locktype = 'advisory'
+  AND objsubid = 1
+  AND database = (SELECT oid FROM pg_database WHERE datname = current_database())`
+
+	// queued jobs are those no worker holds the advisory lock of. que
+	// re-checks a job still exists after locking it, so deleting here is safe.
+	sqlDequeueCleanups = `
+DELETE FROM que_jobs
+WHERE job_class = ANY($1)
+  AND args->>'user_id' = $2
+  AND args->>'channel_id' = $3
+  AND ($4 = '' OR args->>'nonce' = $4)
+  AND job_id NOT IN (` + sqlLockedJobs + `)
+RETURNING job_id`
+
+	sqlRecordDequeued = `
+INSERT INTO cleanup_cancellations (job_id, user_id, channel_id, stopped_at)
+VALUES ($1, $2, $3, now())
+ON CONFLICT (job_id) DO NOTHING`
+
+	sqlRequestCancellation = `
+INSERT INTO cleanup_cancellations (job_id, user_id, channel_id)
+SELECT job_id, $2, $3
+FROM que_jobs
+WHERE job_class = ANY($1)
+  AND args->>'user_id' = $2
+  AND args->>'channel_id' = $3
+  AND ($4 = '' OR args->>'nonce' = $4)
+ON CONFLICT (job_id) DO NOTHING
+RETURNING job_id`
+
+	sqlCancellationRequested = `
+SELECT EXISTS (SELECT 1 FROM cleanup_cancellations WHERE job_id = $1 AND stopped_at IS NULL)`
+
+	sqlRecordStopped = `
+UPDATE cleanup_cancellations
+SET stopped_at = now(),
+    history_latest = $2,
+    deleted_messages = $3,
+    deleted_files = $4
+WHERE job_id = $1
+  AND stopped_at IS NULL`
+)
+
+// CancelResult reports what a cancellation affected
+type CancelResult struct {
+	// Dequeued is the number of jobs removed before they started
+	Dequeued int
+	// Stopping is the number of running jobs asked to stop
+	Stopping int
+}
+
+// cancellableJobs are the job types CancelCleanChannel applies to
+var cancellableJobs = []string{CleanChannelJob, RetentionPolicyJob}
+
+// CancelCleanChannel removes the queued cleanups and retention runs of a
+// user in a channel and asks running ones to stop after their current
+// deletion. A nonce limits it to the single cleanup enqueued with it.
+func (q *PGQueue) CancelCleanChannel(userID, channel, nonce string) (CancelResult, error) {
+	var res CancelResult
+	tx, err := q.pgxpool.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(sqlDequeueCleanups, cancellableJobs, userID, channel, nonce)
+	if err != nil {
+		return res, err
+	}
+	var dequeued []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return res, err
+		}
+		dequeued = append(dequeued, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+	for _, id := range dequeued {
+		if _, err := tx.Exec(sqlRecordDequeued, id, userID, channel); err != nil {
+			return res, err
+		}
+	}
+	res.Dequeued = len(dequeued)
+
+	rows, err = tx.Query(sqlRequestCancellation, cancellableJobs, userID, channel, nonce)
+	if err != nil {
+		return res, err
+	}
+	for rows.Next() {
+		res.Stopping++
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+	return res, tx.Commit()
+}
+
+// cancelled reports whether a cancellation was requested for a job
+func (s *checkpointStore) cancelled(jobID int64) (bool, error) {
+	var requested bool
+	err := s.pool.QueryRow(sqlCancellationRequested, jobID).Scan(&requested)
+	return requested, err
+}
+
+// stopped records how far a cancelled job got, closing its cancellation
+// request
+func (s *checkpointStore) stopped(jobID int64, historyLatest string, deletedMessages, deletedFiles int) error {
+	_, err := s.pool.Exec(sqlRecordStopped, jobID, historyLatest, deletedMessages, deletedFiles)
+	return err
+}
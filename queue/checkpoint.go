@@ -0,0 +1,276 @@
+package queue
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/jackc/pgx"
+)
+
+var (
+	// checkpointInterval throttles how often a running cleanup persists its
+	// cursor and renews its lease
+	checkpointInterval = 5 * time.Second
+	// leaseTimeout is how long a cleanup may go without a heartbeat before it
+	// is rescheduled as stuck
+	leaseTimeout = 5 * time.Minute
+	// reapInterval is how often workers look for stuck cleanups
+	reapInterval = 1 * time.Minute
+)
+
+// errLeaseLost is returned by Save once another run took over the job, e.g.
+// after the connection holding the que lock of this run was lost
+var errLeaseLost = errors.New("job lease lost to another worker")
+
+const (
+	// the run that holds the que lock of a job takes the lease over, an
+	// earlier run of the same job notices on its next save
+	sqlAcquireCheckpoint = `
+INSERT INTO cleanup_checkpoints (job_id, worker, heartbeat_at)
+VALUES ($1, $2, now())
+ON CONFLICT (job_id) DO UPDATE
+SET worker       = EXCLUDED.worker,
+    heartbeat_at = EXCLUDED.heartbeat_at
+RETURNING history_latest, messages_done, kept, scanned_messages, deleted_messages, deleted_files`
+
+	sqlSaveCheckpoint = `
+UPDATE cleanup_checkpoints
+SET history_latest   = $3,
+    messages_done    = $4,
+    kept             = $5,
+    scanned_messages = $6,
+    deleted_messages = $7,
+    deleted_files    = $8,
+    heartbeat_at     = now()
+WHERE job_id = $1
+  AND worker = $2`
+
+	sqlDeleteCheckpoint = `
+DELETE FROM cleanup_checkpoints
+WHERE job_id = $1`
+
+	// only jobs whose run still holds the que lock are stuck, que picks the
+	// others up again by itself
+	sqlStaleCheckpoints = `
+SELECT c.job_id, c.worker
+FROM cleanup_checkpoints c
+JOIN que_jobs j ON j.job_id = c.job_id
+WHERE c.heartbeat_at < now() - $1::interval
+  AND c.job_id IN (` + sqlLockedJobs + `)`
+
+	// revoking the lease makes the next save of the stuck run fail
+	sqlRevokeLease = `
+UPDATE cleanup_checkpoints
+SET worker = ''
+WHERE job_id = $1
+  AND worker = $2
+  AND heartbeat_at < now() - $3::interval`
+
+	// the stuck run keeps the que lock of its job, so the job is moved to a
+	// new id that workers can lock. que ignores the missing row once the
+	// stuck run finishes.
+	sqlRequeueJob = `
+WITH stuck AS (
+  DELETE FROM que_jobs
+  WHERE job_id = $1
+  RETURNING queue, priority, job_class, args, error_count
+)
+INSERT INTO que_jobs (queue, priority, run_at, job_class, args, error_count, last_error)
+SELECT queue, priority, now(), job_class, args, error_count + 1, $2
+FROM stuck
+RETURNING job_id`
+
+	sqlMoveCheckpoint = `
+UPDATE cleanup_checkpoints SET job_id = $2 WHERE job_id = $1`
+
+	sqlMoveCancellation = `
+UPDATE cleanup_cancellations SET job_id = $2 WHERE job_id = $1`
+
+	// checkpoints outlive their job when it is deleted by hand
+	sqlDeleteOrphanCheckpoints = `
+DELETE FROM cleanup_checkpoints c
+WHERE NOT EXISTS (SELECT 1 FROM que_jobs j WHERE j.job_id = c.job_id)`
+)
+
+// Checkpoint is the persisted cursor of a cleanup job. Files are not part of
+// it: deleting files shifts the later pages of files.list, so a resumed job
+// lists them again from the first page.
+type Checkpoint struct {
+	// HistoryLatest is the timestamp of the last message processed
+	HistoryLatest string
+	// MessagesDone is set once the history walk completed
+	MessagesDone bool
+	// Kept is how many recent messages were spared for KeepLast
+	Kept int
+	// ScannedMessages, DeletedMessages and DeletedFiles carry the progress
+	// counters over to the next run
+	ScannedMessages int
+	DeletedMessages int
+	DeletedFiles    int
+	// Lease identifies the run of the job that saves the checkpoint
+	Lease string
+}
+
+// checkpointStore persists cleanup cursors next to the que tables
+type checkpointStore struct {
+	pool   *pgx.ConnPool
+	worker string
+}
+
+func newCheckpointStore(pool *pgx.ConnPool) *checkpointStore {
+	return &checkpointStore{
+		pool:   pool,
+		worker: workerName(),
+	}
+}
+
+// Acquire takes the lease of a job over for a new run, renewing its
+// heartbeat, and returns the checkpoint saved by earlier runs
+func (s *checkpointStore) Acquire(jobID int64) (Checkpoint, error) {
+	lease, err := newLease(s.worker)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	cp := Checkpoint{Lease: lease}
+	err = s.pool.QueryRow(sqlAcquireCheckpoint, jobID, lease).Scan(&cp.HistoryLatest, &cp.MessagesDone, &cp.Kept,
+		&cp.ScannedMessages, &cp.DeletedMessages, &cp.DeletedFiles)
+	return cp, err
+}
+
+// Save persists the checkpoint and renews the job lease. It fails with
+// errLeaseLost when the lease was taken over by another run.
+func (s *checkpointStore) Save(jobID int64, cp Checkpoint) error {
+	tag, err := s.pool.Exec(sqlSaveCheckpoint, jobID, cp.Lease, cp.HistoryLatest, cp.MessagesDone, cp.Kept,
+		cp.ScannedMessages, cp.DeletedMessages, cp.DeletedFiles)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+// Delete removes the checkpoint of a finished job
+func (s *checkpointStore) Delete(jobID int64) error {
+	_, err := s.pool.Exec(sqlDeleteCheckpoint, jobID)
+	return err
+}
+
+// reap reschedules jobs whose lease was not renewed for leaseTimeout while
+// their run still holds the que lock, and drops checkpoints whose job no
+// longer exists. The stuck run is not killed, it loses its lease and stops
+// at its next save.
+func (s *checkpointStore) reap() error {
+	timeout := fmt.Sprintf("%d seconds", int(leaseTimeout.Seconds()))
+	rows, err := s.pool.Query(sqlStaleCheckpoints, timeout)
+	if err != nil {
+		return err
+	}
+	var stale []staleLease
+	for rows.Next() {
+		var l staleLease
+		if err := rows.Scan(&l.jobID, &l.worker); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, l := range stale {
+		if err := s.requeue(l, timeout); err != nil {
+			return err
+		}
+	}
+	_, err = s.pool.Exec(sqlDeleteOrphanCheckpoints)
+	return err
+}
+
+// staleLease is the lease of a job that stopped renewing it
+type staleLease struct {
+	jobID  int64
+	worker string
+}
+
+// requeue moves a stuck job to a new id along with its checkpoint and
+// cancellation request, unless its run renewed the lease in the meantime
+func (s *checkpointStore) requeue(l staleLease, timeout string) error {
+	tx, err := s.pool.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	tag, err := tx.Exec(sqlRevokeLease, l.jobID, l.worker, timeout)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return nil
+	}
+	var newID int64
+	err = tx.QueryRow(sqlRequeueJob, l.jobID, leaseExpiredError(l.worker)).Scan(&newID)
+	if err == pgx.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	for _, stmt := range []string{sqlMoveCheckpoint, sqlMoveCancellation} {
+		if _, err := tx.Exec(stmt, l.jobID, newID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Warn("job lease expired, rescheduled", "job_id", l.jobID, "new_job_id", newID, "worker", l.worker)
+	return nil
+}
+
+// leaseExpiredError is the last error of a job rescheduled off a stuck run
+func leaseExpiredError(worker string) string {
+	return fmt.Sprintf("lease of %s expired after %s", worker, leaseTimeout)
+}
+
+// reapLoop runs reap every reapInterval until done is closed
+func reapLoop(done <-chan struct{}, reap func() error) {
+	ticker := time.NewTicker(reapInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := reap(); err != nil {
+				slog.Warn("unable to reap stale cleanups", "error", err)
+			}
+		}
+	}
+}
+
+// newLease names a run of a job after the worker executing it
+func newLease(worker string) (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return worker + "/" + hex.EncodeToString(b), nil
+}
+
+// workerName identifies this process in checkpoints, preferring the Heroku
+// dyno name
+func workerName() string {
+	if dyno := os.Getenv("DYNO"); dyno != "" {
+		return dyno
+	}
+	host, _ := os.Hostname()
+	return fmt.Sprintf("%s.%d", host, os.Getpid())
+}
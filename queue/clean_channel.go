@@ -2,91 +2,603 @@ package queue
 
 import (
 	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
 	"time"
 
-	que "github.com/bgentry/que-go"
 	"github.com/nlopes/slack"
 	"github.com/pkg/errors"
 )
 
-var rateLimitDelay = 1 * time.Second
-
 // CleanChannelOpts encapsulates all the options for a clean channel command set
 type CleanChannelOpts struct {
 	Messages bool `json:"delete_messages"`
 	Files    bool `json:"delete_files"`
 	Bots     bool `json:"delete_bot_messages"`
+	DryRun   bool `json:"dry_run"`
+	// OlderThanDays limits the cleanup to items older than this many days
+	OlderThanDays int `json:"older_than_days,omitempty"`
+	// Since limits the cleanup to items posted on or after this date
+	Since string `json:"since,omitempty"`
+	// Until limits the cleanup to items posted on or before this date
+	Until string `json:"until,omitempty"`
+	// SkipThreads leaves replies inside threads untouched
+	SkipThreads bool `json:"skip_threads,omitempty"`
+	// Keywords and Pattern limit the cleanup to items whose text contains
+	// one of the keywords or matches the regular expression
+	Keywords []string `json:"keywords,omitempty"`
+	Pattern  string   `json:"pattern,omitempty"`
+	// ExcludeKeywords and ExcludePattern spare items whose text contains one
+	// of the keywords or matches the regular expression
+	ExcludeKeywords []string `json:"exclude_keywords,omitempty"`
+	ExcludePattern  string   `json:"exclude_pattern,omitempty"`
+	// Archive names the sink every item is written to before it is deleted
+	Archive string `json:"archive,omitempty"`
+	// KeepLast spares the most recent messages of the user. Thread replies
+	// are not counted and never deleted with it.
+	KeepLast int `json:"keep_last,omitempty"`
 }
 
-func cleanChannel(j *que.Job) error {
+// String renders the options the way they are typed after /clean
+func (o CleanChannelOpts) String() string {
+	fields := []string{strconv.FormatBool(o.Messages), strconv.FormatBool(o.Files), strconv.FormatBool(o.Bots)}
+	if o.DryRun {
+		fields = append(fields, "--dry-run")
+	}
+	if o.SkipThreads {
+		fields = append(fields, "--skip-threads")
+	}
+	if o.OlderThanDays > 0 {
+		fields = append(fields, "--older-than="+strconv.Itoa(o.OlderThanDays))
+	}
+	if o.Since != "" {
+		fields = append(fields, "--since="+o.Since)
+	}
+	if o.Until != "" {
+		fields = append(fields, "--until="+o.Until)
+	}
+	for _, k := range o.Keywords {
+		fields = append(fields, "--match="+strconv.Quote(k))
+	}
+	if o.Pattern != "" {
+		fields = append(fields, "--regex="+strconv.Quote(o.Pattern))
+	}
+	for _, k := range o.ExcludeKeywords {
+		fields = append(fields, "--exclude="+strconv.Quote(k))
+	}
+	if o.ExcludePattern != "" {
+		fields = append(fields, "--exclude-regex="+strconv.Quote(o.ExcludePattern))
+	}
+	if o.Archive != "" {
+		fields = append(fields, "--archive="+o.Archive)
+	}
+	if o.KeepLast > 0 {
+		fields = append(fields, "--keep-last="+strconv.Itoa(o.KeepLast))
+	}
+	return strings.Join(fields, " ")
+}
+
+// Describe spells out what a cleanup with the options deletes
+func (o CleanChannelOpts) Describe(channel string) string {
+	var what []string
+	if o.Messages {
+		if o.SkipThreads {
+			what = append(what, "your messages, leaving thread replies")
+		} else {
+			what = append(what, "your messages, including thread replies")
+		}
+	}
+	if o.Files {
+		what = append(what, "your files")
+	}
+	if o.Bots {
+		what = append(what, "bot messages")
+	}
+	if len(what) == 0 {
+		what = append(what, "nothing")
+	}
+	lines := []string{fmt.Sprintf("This will permanently delete from <#%s>:", channel)}
+	for _, w := range what {
+		lines = append(lines, "• "+w)
+	}
+	var limits []string
+	if o.OlderThanDays > 0 {
+		limits = append(limits, fmt.Sprintf("older than %d days", o.OlderThanDays))
+	}
+	if o.Since != "" {
+		limits = append(limits, "posted on or after "+o.Since)
+	}
+	if o.Until != "" {
+		limits = append(limits, "posted on or before "+o.Until)
+	}
+	if len(o.Keywords) > 0 {
+		limits = append(limits, "containing "+strings.Join(o.Keywords, " or "))
+	}
+	if o.Pattern != "" {
+		limits = append(limits, "matching /"+o.Pattern+"/")
+	}
+	if len(o.ExcludeKeywords) > 0 {
+		limits = append(limits, "not containing "+strings.Join(o.ExcludeKeywords, " or "))
+	}
+	if o.ExcludePattern != "" {
+		limits = append(limits, "not matching /"+o.ExcludePattern+"/")
+	}
+	if len(limits) > 0 {
+		lines = append(lines, "Only items "+strings.Join(limits, ", ")+".")
+	}
+	if o.KeepLast > 0 {
+		lines = append(lines, fmt.Sprintf("Your last %d messages are kept.", o.KeepLast))
+	}
+	if o.Archive != "" {
+		lines = append(lines, "Everything is archived as "+o.Archive+" before it is deleted.")
+	}
+	return strings.Join(lines, "\n")
+}
+
+// channelCleaner walks the history and files of a channel and removes
+// everything matched by the request options. In dry run mode nothing is
+// removed and the matches are only tallied into the summary.
+//
+// Progress is checkpointed so a retried job resumes where the previous
+// attempt stopped instead of rescanning the whole channel.
+type channelCleaner struct {
+	api         *limitedClient
+	req         CleanChannelRequest
+	window      timeWindow
+	filter      *contentFilter
+	archiver    Archiver
+	summary     *CleanupSummary
+	progress    *cleanupProgress
+	jobID       int64
+	checkpoints jobState
+	audit       auditLog
+	cp          Checkpoint
+	savedAt     time.Time
+	checkedAt   time.Time
+	seen        map[string]bool
+	logger      *slog.Logger
+}
+
+func (r *runner) cleanChannel(j job) error {
 	var ccr CleanChannelRequest
-	var more bool
 	if err := json.Unmarshal(j.Args, &ccr); err != nil {
-		return errors.Wrap(err, "Unable to unmarshal job arguments into CleanChannelRequest: "+string(j.Args))
+		return errors.Wrap(err, "Unable to unmarshal job arguments into CleanChannelRequest")
+	}
+	return r.runCleanup(j, ccr)
+}
+
+// runCleanup drives a channelCleaner for a cleanup or retention job
+func (r *runner) runCleanup(j job, ccr CleanChannelRequest) error {
+	token, err := r.token(ccr.TeamID, ccr.EnterpriseID, ccr.UserID)
+	if err != nil {
+		return err
+	}
+	if ccr.Options.KeepLast > 0 {
+		// only the user's own messages are counted, so files and bot
+		// messages would otherwise be deleted regardless of their age.
+		// Replies are reached through their parent, out of order with the
+		// newest first walk of the history, so they are left alone too.
+		ccr.Options.Files, ccr.Options.Bots, ccr.Options.SkipThreads = false, false, true
+	}
+	now := time.Now()
+	c := &channelCleaner{
+		api:         r.limiter.client(token, ccr.TeamID),
+		req:         ccr,
+		summary:     NewCleanupSummary(now),
+		progress:    newCleanupProgress(ccr, now),
+		jobID:       j.ID,
+		checkpoints: r.state,
+		audit:       r.audit,
+		seen:        make(map[string]bool),
+		logger:      slog.With("job_id", j.ID, "request_id", ccr.RequestID),
 	}
-	api := slack.New(ccr.Token)
-	if ccr.Options.Messages || ccr.Options.Bots {
-		more = true
-		historyParams := &slack.GetConversationHistoryParameters{
-			ChannelID: ccr.Channel,
+	if !ccr.Options.DryRun {
+		// taking the lease over up front renews the heartbeat before the
+		// first item is processed
+		cp, err := r.state.Acquire(j.ID)
+		if err != nil {
+			return errors.Wrap(err, "Unable to load the cleanup checkpoint")
 		}
-		for more {
-			history, err := api.GetConversationHistory(historyParams)
-			if err != nil {
-				return err
+		c.cp = cp
+		c.progress.resume(cp)
+	}
+	if ccr.Options.hasDateFilter() {
+		var err error
+		if c.window, err = ccr.Options.window(userLocation(c.api, ccr.UserID, c.logger), now); err != nil {
+			return err
+		}
+	}
+	if ccr.Options.hasContentFilter() {
+		var err error
+		if c.filter, err = ccr.Options.contentFilter(); err != nil {
+			return errors.Wrap(err, "Invalid content filter")
+		}
+	}
+	if ccr.ResponseURL != "" {
+		c.historySpan()
+	}
+	if ccr.Options.Archive != "" && !ccr.Options.DryRun {
+		archiver, err := newArchiver(r.archiveRoot, j.ID, ccr)
+		if err != nil {
+			return errors.Wrap(err, "Unable to open the archive")
+		}
+		c.archiver = archiver
+		// a failed attempt only closes the journal, the retry appends to it
+		defer func() {
+			if c.archiver == nil {
+				return
+			}
+			if _, err := c.archiver.Close(); err != nil {
+				c.logger.Error("unable to close the archive", "error", err)
 			}
-			more = history.HasMore
-			if len(history.Messages) == 0 {
-				break
-			}
-			for _, m := range history.Messages {
-				// delete messages from the user
-				historyParams.Latest = m.Timestamp
-				if m.Type == "message" {
-					if ccr.Options.Messages {
-						if m.User == ccr.UserID {
-							_, _, err = api.DeleteMessage(ccr.Channel, m.Timestamp)
-							if err != nil {
-								return err
-							}
-							time.Sleep(rateLimitDelay)
-						}
-					}
-					if ccr.Options.Bots {
-						if m.SubType == "bot_message" {
-							_, _, err = api.DeleteMessage(ccr.Channel, m.Timestamp)
-							if err != nil {
-								return err
-							}
-							time.Sleep(rateLimitDelay)
-						}
-					}
+		}()
+	}
+	err = c.cleanMessages()
+	if err == nil {
+		err = c.cleanFiles()
+	}
+	if err == errCleanupCancelled {
+		return c.stop()
+	}
+	if err != nil {
+		return err
+	}
+	if ccr.Options.DryRun && ccr.Nonce != "" {
+		// the dry run previews a cleanup the user has yet to confirm
+		opts := ccr.Options
+		opts.DryRun = false
+		return c.notify(c.summary.ConfirmMessage(ccr.Channel, opts, ccr.Nonce))
+	}
+	if ccr.Options.DryRun {
+		return c.notify(c.summary.Message(ccr.Channel))
+	}
+	if err := c.deliverArchive(); err != nil {
+		return err
+	}
+	// a cancellation requested after the last check came too late
+	if err := r.state.stopped(j.ID, c.cp.HistoryLatest, c.progress.DeletedMessages, c.progress.DeletedFiles); err != nil {
+		return err
+	}
+	if err := r.state.Delete(j.ID); err != nil {
+		return err
+	}
+	if err := c.notify(c.progress.Finished()); err != nil {
+		c.logger.Warn("unable to report the cleanup result", "error", err)
+	}
+	return nil
+}
+
+// historySpan sets the range of history the progress estimate is based on,
+// from the window or the channel creation up to now. The channel lookup
+// needs scopes the install may lack, so without it progress has no estimate
+func (c *channelCleaner) historySpan() {
+	if !c.window.latest.IsZero() {
+		c.progress.newest = c.window.latest
+	}
+	if !c.window.oldest.IsZero() {
+		c.progress.oldest = c.window.oldest
+		return
+	}
+	channel, err := c.api.GetConversationInfo(c.req.Channel)
+	if err != nil {
+		c.logger.Warn("unable to read the channel info for the progress estimate", "error", err)
+		return
+	}
+	c.progress.oldest = channel.Created.Time()
+}
+
+// notify sends the result of the cleanup to the response_url, or as a direct
+// message once Slack no longer accepts posts to it
+func (c *channelCleaner) notify(msg slack.Msg) error {
+	if c.req.ResponseURL == "" {
+		return nil
+	}
+	if !c.progress.responseURLExpired() {
+		return Respond(c.req.ResponseURL, msg)
+	}
+	return c.api.PostMessage(c.req.UserID, msg)
+}
+
+// deliverArchive closes the archive and uploads it as a private file of the
+// user, since the archive directory only lives on the disk of the worker
+func (c *channelCleaner) deliverArchive() error {
+	if c.archiver == nil {
+		return nil
+	}
+	path, err := c.archiver.Close()
+	c.archiver = nil
+	if err != nil {
+		return errors.Wrap(err, "Unable to close the archive")
+	}
+	params, err := archiveUpload(path, c.jobID, c.req)
+	if err != nil {
+		return errors.Wrap(err, "Unable to package the archive")
+	}
+	file, err := c.api.UploadFile(params)
+	if err != nil {
+		return errors.Wrap(err, "Unable to upload the archive")
+	}
+	c.logger.Info("cleanup archived", "path", path, "file_id", file.ID)
+	c.progress.archiveURL = file.Permalink
+	return nil
+}
+
+// step is called after every processed item to keep the user informed,
+// renew the lease of the job and notice cancellation requests
+func (c *channelCleaner) step() error {
+	if err := c.progress.report(); err != nil {
+		c.logger.Warn("unable to report the cleanup progress", "error", err)
+	}
+	if time.Since(c.checkedAt) >= cancelCheckInterval {
+		cancelled, err := c.checkpoints.cancelled(c.jobID)
+		if err != nil {
+			return errors.Wrap(err, "Unable to check for a cancellation request")
+		}
+		if cancelled {
+			return errCleanupCancelled
+		}
+		c.checkedAt = time.Now()
+	}
+	return c.checkpoint(false)
+}
+
+// stop records how far a cancelled cleanup got and lets the user know. The
+// job then completes normally so que does not retry it.
+func (c *channelCleaner) stop() error {
+	p := c.progress
+	if err := c.deliverArchive(); err != nil {
+		c.logger.Error("unable to deliver the archive of the cancelled cleanup", "error", err)
+	}
+	if err := c.checkpoints.stopped(c.jobID, c.cp.HistoryLatest, p.DeletedMessages, p.DeletedFiles); err != nil {
+		return err
+	}
+	if err := c.checkpoints.Delete(c.jobID); err != nil {
+		return err
+	}
+	if err := c.notify(p.Cancelled()); err != nil {
+		c.logger.Warn("unable to report the cleanup cancellation", "error", err)
+	}
+	return nil
+}
+
+// checkpoint persists the cursor and renews the lease of the job, at most
+// once per checkpointInterval unless forced. Dry runs are never checkpointed.
+func (c *channelCleaner) checkpoint(force bool) error {
+	if c.req.Options.DryRun {
+		return nil
+	}
+	if !force && time.Since(c.savedAt) < checkpointInterval {
+		return nil
+	}
+	c.cp.ScannedMessages = c.progress.ScannedMessages
+	c.cp.DeletedMessages = c.progress.DeletedMessages
+	c.cp.DeletedFiles = c.progress.DeletedFiles
+	if err := c.checkpoints.Save(c.jobID, c.cp); err != nil {
+		return errors.Wrap(err, "Unable to save the cleanup checkpoint")
+	}
+	c.savedAt = time.Now()
+	return nil
+}
+
+// cleanMessages pages backwards through the channel history handling the
+// user and bot messages selected by the options
+func (c *channelCleaner) cleanMessages() error {
+	opts := c.req.Options
+	if (!opts.Messages && !opts.Bots) || c.cp.MessagesDone {
+		return nil
+	}
+	more := true
+	historyParams := &slack.GetConversationHistoryParameters{
+		ChannelID: c.req.Channel,
+	}
+	historyParams.Oldest, historyParams.Latest = c.window.historyBounds()
+	if c.cp.HistoryLatest != "" {
+		historyParams.Latest = c.cp.HistoryLatest
+	}
+	for more {
+		history, err := c.api.GetConversationHistory(historyParams)
+		if err != nil {
+			return err
+		}
+		more = history.HasMore
+		if len(history.Messages) == 0 {
+			break
+		}
+		for _, m := range history.Messages {
+			historyParams.Latest = m.Timestamp
+			if t, err := parseTimestamp(m.Timestamp); err == nil {
+				c.progress.position = t
+			}
+			// replies go first, a deleted parent can no longer be traversed
+			if isThreadParent(m) && !opts.SkipThreads {
+				if err := c.cleanReplies(m); err != nil {
+					return err
 				}
 			}
+			if err := c.handleMessage(m); err != nil {
+				return err
+			}
+			c.cp.HistoryLatest = m.Timestamp
+			if err := c.step(); err != nil {
+				return err
+			}
 		}
 	}
-	if ccr.Options.Files {
-		more = true
-		fileParams := slack.GetFilesParameters{
-			User:    ccr.UserID,
-			Channel: ccr.Channel,
-			Page:    1,
+	c.cp.MessagesDone = true
+	return c.checkpoint(true)
+}
+
+// cleanReplies pages through the replies of a thread parent applying the
+// same filters as to top level messages
+func (c *channelCleaner) cleanReplies(parent slack.Message) error {
+	params := &slack.GetConversationRepliesParameters{
+		ChannelID: c.req.Channel,
+		Timestamp: parent.Timestamp,
+	}
+	for {
+		replies, more, cursor, err := c.api.GetConversationReplies(params)
+		if err != nil {
+			return err
 		}
-		for more {
-			files, paging, err := api.GetFiles(fileParams)
-			if err != nil {
+		for _, r := range replies {
+			// the parent is returned as part of its own thread
+			if r.Timestamp == parent.Timestamp {
+				continue
+			}
+			if t, err := parseTimestamp(r.Timestamp); err == nil && !c.window.contains(t) {
+				continue
+			}
+			if err := c.handleMessage(r); err != nil {
 				return err
 			}
-			more = paging.Page < paging.Pages
-			fileParams.Page = paging.Page + 1
-			for _, f := range files {
-				err = api.DeleteFile(f.ID)
-				if err != nil {
+			if err := c.step(); err != nil {
+				return err
+			}
+		}
+		if !more || cursor == "" {
+			return nil
+		}
+		params.Cursor = cursor
+	}
+}
+
+// handleMessage deletes a message if it matches the user or bot filters,
+// along with the files attached to the user's own thread replies
+func (c *channelCleaner) handleMessage(m slack.Message) error {
+	opts := c.req.Options
+	if m.Type != "message" {
+		return nil
+	}
+	c.progress.ScannedMessages++
+	if !c.filter.matchesMessage(m) {
+		return nil
+	}
+	// delete messages from the user
+	if opts.Messages && m.User == c.req.UserID {
+		if c.cp.Kept < opts.KeepLast {
+			c.cp.Kept++
+			return nil
+		}
+		if opts.Files && isThreadReply(m) {
+			for _, f := range m.Files {
+				if err := c.deleteFile(f); err != nil {
 					return err
 				}
-				time.Sleep(rateLimitDelay)
 			}
 		}
+		return c.deleteMessage(m, CategoryOwn)
+	}
+	if opts.Bots && m.SubType == "bot_message" {
+		return c.deleteMessage(m, CategoryBot)
+	}
+	return nil
+}
+
+// cleanFiles pages through the files the user shared in the channel
+func (c *channelCleaner) cleanFiles() error {
+	if !c.req.Options.Files {
+		return nil
+	}
+	more := true
+	fileParams := slack.NewGetFilesParameters()
+	fileParams.User = c.req.UserID
+	fileParams.Channel = c.req.Channel
+	c.window.fileBounds(&fileParams)
+	c.progress.startFiles()
+	for more {
+		files, paging, err := c.api.GetFiles(fileParams)
+		if err != nil {
+			return err
+		}
+		more = paging.Page < paging.Pages
+		c.progress.filePage, c.progress.filePages = paging.Page, paging.Pages
+		deleted := c.progress.DeletedFiles
+		for _, f := range files {
+			c.progress.ScannedFiles++
+			if !c.window.contains(f.Created.Time()) || !c.filter.matchesFile(f) {
+				continue
+			}
+			if err := c.deleteFile(f); err != nil {
+				return err
+			}
+			if err := c.step(); err != nil {
+				return err
+			}
+		}
+		// deletions move later files up, so a page that lost files is
+		// listed again until it only holds files that are kept
+		if c.req.Options.DryRun || c.progress.DeletedFiles == deleted {
+			fileParams.Page = paging.Page + 1
+		} else {
+			more = true
+		}
+		if err := c.checkpoint(true); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *channelCleaner) deleteMessage(m slack.Message, category string) error {
+	// thread broadcasts show up in both the history and the thread
+	if c.seen[m.Timestamp] {
+		return nil
+	}
+	c.seen[m.Timestamp] = true
+	if c.req.Options.DryRun {
+		c.summary.AddMessage(m, category)
+	} else {
+		if c.archiver != nil {
+			if err := c.archiver.ArchiveMessage(m, category); err != nil {
+				return errors.Wrap(err, "Unable to archive message")
+			}
+		}
+		err := c.api.DeleteMessage(c.req.Channel, m.Timestamp)
+		if err := recordDeletion(c.audit, c.messageAudit(m, category), err); err != nil {
+			return err
+		}
+		if err != nil && !alreadyGone(err) {
+			return err
+		}
+	}
+	c.progress.DeletedMessages++
+	return nil
+}
+
+func (c *channelCleaner) deleteFile(f slack.File) error {
+	// files shared in threads are also returned by files.list
+	if c.seen[f.ID] {
+		return nil
+	}
+	c.seen[f.ID] = true
+	if c.req.Options.DryRun {
+		c.summary.AddFile(f)
+	} else {
+		if c.archiver != nil {
+			if err := c.archiver.ArchiveFile(f); err != nil {
+				return errors.Wrap(err, "Unable to archive file")
+			}
+		}
+		err := c.api.DeleteFile(f.ID)
+		if err := recordDeletion(c.audit, c.fileAudit(f), err); err != nil {
+			return err
+		}
+		if err != nil && !alreadyGone(err) {
+			return err
+		}
 	}
+	c.progress.DeletedFiles++
 	return nil
 }
+
+// isThreadParent reports whether a message has replies
+func isThreadParent(m slack.Message) bool {
+	return m.ReplyCount > 0 && (m.ThreadTimestamp == "" || m.ThreadTimestamp == m.Timestamp)
+}
+
+// isThreadReply reports whether a message was posted inside a thread
+func isThreadReply(m slack.Message) bool {
+	return m.ThreadTimestamp != "" && m.ThreadTimestamp != m.Timestamp
+}
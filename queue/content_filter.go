@@ -0,0 +1,93 @@
+package queue
+
+import (
+	"regexp"
+	"strings"
+
+	"github.com/nlopes/slack"
+)
+
+// contentFilter selects messages and files by their text. An item matches
+// when it contains any of the keywords or matches the pattern (or there are
+// neither), and contains none of the excluded keywords and does not match
+// the excluded pattern. Keywords are case insensitive.
+type contentFilter struct {
+	keywords        []string
+	pattern         *regexp.Regexp
+	excludeKeywords []string
+	excludePattern  *regexp.Regexp
+}
+
+// hasContentFilter reports whether any of the text filters are set
+func (o CleanChannelOpts) hasContentFilter() bool {
+	return len(o.Keywords) > 0 || o.Pattern != "" || len(o.ExcludeKeywords) > 0 || o.ExcludePattern != ""
+}
+
+// contentFilter compiles the text filters of the options
+func (o CleanChannelOpts) contentFilter() (*contentFilter, error) {
+	f := &contentFilter{
+		keywords:        lowerAll(o.Keywords),
+		excludeKeywords: lowerAll(o.ExcludeKeywords),
+	}
+	var err error
+	if o.Pattern != "" {
+		if f.pattern, err = regexp.Compile(o.Pattern); err != nil {
+			return nil, err
+		}
+	}
+	if o.ExcludePattern != "" {
+		if f.excludePattern, err = regexp.Compile(o.ExcludePattern); err != nil {
+			return nil, err
+		}
+	}
+	return f, nil
+}
+
+// matches reports whether text passes the filter
+func (f *contentFilter) matches(text string) bool {
+	if f == nil {
+		return true
+	}
+	lower := strings.ToLower(text)
+	if containsAny(lower, f.excludeKeywords) {
+		return false
+	}
+	if f.excludePattern != nil && f.excludePattern.MatchString(text) {
+		return false
+	}
+	if len(f.keywords) == 0 && f.pattern == nil {
+		return true
+	}
+	return containsAny(lower, f.keywords) || (f.pattern != nil && f.pattern.MatchString(text))
+}
+
+// matchesMessage checks the message text along with its attachments
+func (f *contentFilter) matchesMessage(m slack.Message) bool {
+	texts := []string{m.Text}
+	for _, a := range m.Attachments {
+		texts = append(texts, a.Pretext, a.Title, a.Text, a.Fallback)
+	}
+	return f.matches(strings.Join(texts, "\n"))
+}
+
+// matchesFile checks the file name and title
+func (f *contentFilter) matchesFile(file slack.File) bool {
+	return f.matches(file.Name + "\n" + file.Title)
+}
+
+func containsAny(text string, keywords []string) bool {
+	for _, k := range keywords {
+		if strings.Contains(text, k) {
+			return true
+		}
+	}
+	return false
+}
+
+func lowerAll(s []string) []string {
+	lower := make([]string, len(s))
+	for i, v := range s {
+		lower[i] = strings.ToLower(v)
+	}
+	return lower
+}
@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"testing"
+
+	"github.com/nlopes/slack"
+)
+
+func TestContentFilter(t *testing.T) {
+	tests := []struct {
+		name string
+		opts CleanChannelOpts
+		text string
+		want bool
+	}{
+		{"no filter", CleanChannelOpts{}, "anything", true},
+		{"keyword", CleanChannelOpts{Keywords: []string{"deploy"}}, "Deploying now", true},
+		{"keyword case insensitive", CleanChannelOpts{Keywords: []string{"DEPLOY"}}, "deploy done", true},
+		{"keyword missing", CleanChannelOpts{Keywords: []string{"deploy"}}, "lunch?", false},
+		{"any keyword", CleanChannelOpts{Keywords: []string{"deploy", "lunch"}}, "lunch?", true},
+		{"pattern", CleanChannelOpts{Pattern: `https?://`}, "see http://example.com", true},
+		{"pattern missing", CleanChannelOpts{Pattern: `https?://`}, "see example.com", false},
+		{"keyword or pattern", CleanChannelOpts{Keywords: []string{"deploy"}, Pattern: `^#\d+`}, "#42 merged", true},
+		{"excluded keyword", CleanChannelOpts{ExcludeKeywords: []string{"keep"}}, "KEEP this", false},
+		{"excluded keyword missing", CleanChannelOpts{ExcludeKeywords: []string{"keep"}}, "drop this", true},
+		{"excluded pattern", CleanChannelOpts{ExcludePattern: `^!`}, "!important", false},
+		{"exclusion wins", CleanChannelOpts{Keywords: []string{"deploy"}, ExcludeKeywords: []string{"prod"}}, "deploy to prod", false},
+		{"exclusion wins over pattern", CleanChannelOpts{Pattern: "deploy", ExcludePattern: "prod"}, "deploy to prod", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, err := tt.opts.contentFilter()
+			if err != nil {
+				t.Fatalf("contentFilter() error = %v", err)
+			}
+			if got := f.matches(tt.text); got != tt.want {
+				t.Errorf("matches(%q) = %v, want %v", tt.text, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentFilterInvalidPattern(t *testing.T) {
+	for _, opts := range []CleanChannelOpts{{Pattern: "("}, {ExcludePattern: "["}} {
+		if _, err := opts.contentFilter(); err == nil {
+			t.Errorf("contentFilter(%+v) succeeded, want an error", opts)
+		}
+	}
+}
+
+func TestContentFilterItems(t *testing.T) {
+	f, err := CleanChannelOpts{Keywords: []string{"release"}}.contentFilter()
+	if err != nil {
+		t.Fatalf("contentFilter() error = %v", err)
+	}
+	var unfiltered *contentFilter
+	tests := []struct {
+		name string
+		got  bool
+		want bool
+	}{
+		{"message text", f.matchesMessage(slack.Message{Msg: slack.Msg{Text: "release notes"}}), true},
+		{"attachment", f.matchesMessage(slack.Message{Msg: slack.Msg{Text: "see below", Attachments: []slack.Attachment{{Title: "Release 1.2"}}}}), true},
+		{"unrelated message", f.matchesMessage(slack.Message{Msg: slack.Msg{Text: "see below"}}), false},
+		{"file name", f.matchesFile(slack.File{Name: "release.pdf"}), true},
+		{"file title", f.matchesFile(slack.File{Name: "notes.pdf", Title: "Release notes"}), true},
+		{"unrelated file", f.matchesFile(slack.File{Name: "notes.pdf"}), false},
+		{"nil filter", unfiltered.matchesFile(slack.File{Name: "notes.pdf"}), true},
+	}
+	for _, tt := range tests {
+		if tt.got != tt.want {
+			t.Errorf("%s: matched = %v, want %v", tt.name, tt.got, tt.want)
+		}
+	}
+}
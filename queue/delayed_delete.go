@@ -3,17 +3,51 @@ package queue
 import (
 	"encoding/json"
 
-	que "github.com/bgentry/que-go"
-	"github.com/nlopes/slack"
 	"github.com/pkg/errors"
 )
 
-func delayedDelete(j *que.Job) error {
+// alreadyGone reports whether a delete failed because the item no longer
+// exists, which happens when the user removed it first or the same item was
+// scheduled twice
+func alreadyGone(err error) bool {
+	if err == nil {
+		return false
+	}
+	switch err.Error() {
+	case "message_not_found", "file_not_found", "file_deleted":
+		return true
+	}
+	return false
+}
+
+func (r *runner) delayedDelete(j job) error {
 	var ddr DelayedDeleteRequest
 	if err := json.Unmarshal(j.Args, &ddr); err != nil {
-		return errors.Wrap(err, "Unable to unmarshal job arguments into DelayedDeleteRequest: "+string(j.Args))
+		return errors.Wrap(err, "Unable to unmarshal job arguments into DelayedDeleteRequest")
+	}
+	token, err := r.token(ddr.TeamID, ddr.EnterpriseID, ddr.UserID)
+	if err != nil {
+		return err
+	}
+	api := r.limiter.client(token, ddr.TeamID)
+	entry := AuditEntry{
+		TeamID:  ddr.TeamID,
+		UserID:  ddr.UserID,
+		Channel: ddr.Channel,
+		JobID:   j.ID,
+	}
+	if ddr.FileID != "" {
+		entry.FileID, entry.Category = ddr.FileID, CategoryFile
+		err = api.DeleteFile(ddr.FileID)
+	} else {
+		entry.Timestamp, entry.Category = ddr.Timestamp, CategoryOwn
+		err = api.DeleteMessage(ddr.Channel, ddr.Timestamp)
+	}
+	if err := recordDeletion(r.audit, entry, err); err != nil {
+		return err
+	}
+	if alreadyGone(err) {
+		return nil
 	}
-	api := slack.New(ddr.Token)
-	_, _, err := api.DeleteMessage(ddr.Channel, ddr.Timestamp)
 	return err
 }
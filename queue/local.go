@@ -0,0 +1,651 @@
+package queue
+
+import (
+	"database/sql"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/king-jam/channel-cleaner/migrations"
+	_ "github.com/mattn/go-sqlite3" // registers the sqlite3 driver
+)
+
+// localPollInterval is how often idle local workers look for due jobs that
+// were scheduled for later
+var localPollInterval = time.Second
+
+const (
+	// jobs that were running when the process stopped resume from their
+	// checkpoint
+	sqlResetLocalJobs = `
+UPDATE local_jobs SET running = false WHERE running`
+
+	sqlEnqueueLocalJob = `
+INSERT INTO local_jobs (job_class, args, run_at) VALUES (?, ?, ?)`
+
+	sqlClaimLocalJob = `
+UPDATE local_jobs SET running = true
+WHERE job_id = (
+  SELECT job_id FROM local_jobs
+  WHERE NOT running AND run_at <= ?
+  ORDER BY run_at, job_id
+  LIMIT 1
+)
+RETURNING job_id, job_class, args, error_count`
+
+	sqlFinishLocalJob = `
+DELETE FROM local_jobs WHERE job_id = ?`
+
+	sqlRetryLocalJob = `
+UPDATE local_jobs
+SET running = false, error_count = error_count + 1, last_error = ?, run_at = ?
+WHERE job_id = ?`
+
+	sqlLocalUserJobs = `
+SELECT j.job_id, j.job_class, j.args, j.run_at, j.error_count, j.last_error, j.running,
+       (SELECT count(*)
+        FROM local_jobs o
+        WHERE NOT o.running
+          AND o.run_at <= ?
+          AND (o.run_at < j.run_at OR (o.run_at = j.run_at AND o.job_id < j.job_id))) + 1
+FROM local_jobs j
+WHERE j.job_class IN (%s)
+  AND json_extract(j.args, '$.team_id') = ?
+  AND json_extract(j.args, '$.user_id') = ?
+ORDER BY j.run_at, j.job_id`
+
+	sqlLocalBacklog = `
+SELECT job_class,
+       count(*),
+       coalesce(?1 - min(CASE WHEN run_at <= ?1 THEN run_at END), 0)
+FROM local_jobs
+GROUP BY job_class`
+
+	sqlLocalPendingRetention = `
+SELECT EXISTS (
+  SELECT 1 FROM local_jobs
+  WHERE job_class = ?
+    AND json_extract(args, '$.policy_id') = ?
+)`
+
+	sqlLocalDequeueCleanups = `
+DELETE FROM local_jobs
+WHERE job_class IN (%s)
+  AND json_extract(args, '$.user_id') = ?
+  AND json_extract(args, '$.channel_id') = ?
+  AND (? = '' OR json_extract(args, '$.nonce') = ?)
+  AND NOT running
+RETURNING job_id`
+
+	sqlLocalRecordDequeued = `
+INSERT INTO local_cancellations (job_id, user_id, channel_id, requested_at, stopped_at)
+VALUES (?, ?, ?, ?, ?)
+ON CONFLICT (job_id) DO NOTHING`
+
+	sqlLocalRequestCancellation = `
+INSERT INTO local_cancellations (job_id, user_id, channel_id, requested_at)
+SELECT job_id, json_extract(args, '$.user_id'), json_extract(args, '$.channel_id'), ?
+FROM local_jobs
+WHERE job_class IN (%s)
+  AND %s
+ON CONFLICT (job_id) DO NOTHING`
+
+	sqlLocalDequeueRevoked = `
+DELETE FROM local_jobs
+WHERE NOT running
+  AND %s`
+
+	sqlLocalRecordDeletion = `
+INSERT INTO local_deletion_audit
+  (team_id, user_id, channel_id, message_ts, file_id, category, content_hash, job_id, outcome, slack_error, attempted_at)
+VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+
+	sqlLocalAuditLog = `
+SELECT id, team_id, user_id, channel_id, message_ts, file_id, category, content_hash, job_id, outcome, slack_error, attempted_at
+FROM local_deletion_audit
+WHERE team_id = ?1
+  AND (?2 = '' OR user_id = ?2)
+  AND (?3 = '' OR channel_id = ?3)
+  AND attempted_at >= ?4
+ORDER BY attempted_at DESC, id DESC
+LIMIT CASE WHEN ?5 > 0 THEN ?5 ELSE -1 END`
+
+	sqlLocalAcquireCheckpoint = `
+INSERT INTO local_checkpoints (job_id, worker, heartbeat_at)
+VALUES (?, ?, ?)
+ON CONFLICT (job_id) DO UPDATE
+SET worker       = excluded.worker,
+    heartbeat_at = excluded.heartbeat_at
+RETURNING history_latest, messages_done, kept, scanned_messages, deleted_messages, deleted_files`
+
+	sqlLocalSaveCheckpoint = `
+UPDATE local_checkpoints
+SET history_latest   = ?,
+    messages_done    = ?,
+    kept             = ?,
+    scanned_messages = ?,
+    deleted_messages = ?,
+    deleted_files    = ?,
+    heartbeat_at     = ?
+WHERE job_id = ?
+  AND worker = ?`
+
+	sqlLocalStaleCheckpoints = `
+SELECT c.job_id, c.worker
+FROM local_checkpoints c
+JOIN local_jobs j ON j.job_id = c.job_id
+WHERE j.running
+  AND c.heartbeat_at < ?`
+
+	sqlLocalRevokeLease = `
+UPDATE local_checkpoints
+SET worker = ''
+WHERE job_id = ?
+  AND worker = ?
+  AND heartbeat_at < ?`
+
+	sqlLocalRequeueJob = `
+INSERT INTO local_jobs (job_class, args, run_at, error_count, last_error)
+SELECT job_class, args, ?, error_count + 1, ?
+FROM local_jobs
+WHERE job_id = ?`
+
+	sqlLocalMoveCheckpoint = `
+UPDATE local_checkpoints SET job_id = ? WHERE job_id = ?`
+
+	sqlLocalMoveCancellation = `
+UPDATE local_cancellations SET job_id = ? WHERE job_id = ?`
+
+	sqlLocalDeleteOrphanCheckpoints = `
+DELETE FROM local_checkpoints
+WHERE job_id NOT IN (SELECT job_id FROM local_jobs)`
+
+	sqlLocalDeleteCheckpoint = `
+DELETE FROM local_checkpoints WHERE job_id = ?`
+
+	sqlLocalCancellationRequested = `
+SELECT EXISTS (SELECT 1 FROM local_cancellations WHERE job_id = ? AND stopped_at IS NULL)`
+
+	sqlLocalRecordStopped = `
+UPDATE local_cancellations
+SET stopped_at = ?,
+    history_latest = ?,
+    deleted_messages = ?,
+    deleted_files = ?
+WHERE job_id = ?
+  AND stopped_at IS NULL`
+)
+
+// LocalQueue is a Queue whose workers run inside the web process. Jobs are
+// kept in SQLite, so scheduled jobs survive a restart when it is backed by a
+// file. It suits a single process, there is no coordination between several.
+type LocalQueue struct {
+	*runner
+	producer
+	db         *sql.DB
+	state      localState
+	numWorkers int
+	wake       chan struct{}
+	done       chan struct{}
+	wg         sync.WaitGroup
+}
+
+// NewLocalQueue opens the SQLite database at path, as built by
+// backend.SQLitePath, :memory: keeping the jobs in memory only
+func NewLocalQueue(path string, tokens TokenSource) (*LocalQueue, error) {
+	db, err := sql.Open("sqlite3", path)
+	if err != nil {
+		return nil, err
+	}
+	// a single connection serializes writers and keeps :memory: alive
+	db.SetMaxOpenConns(1)
+	applied, err := migrations.RunSQLite(db)
+	for _, m := range applied {
+		slog.Info("applied local queue migration", "version", m.Version, "name", m.Name)
+	}
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if _, err := db.Exec(sqlResetLocalJobs); err != nil {
+		db.Close()
+		return nil, err
+	}
+	state := localState{db: db, worker: workerName()}
+	q := &LocalQueue{
+		state:  state,
+		runner: newRunner(state, state, tokens),
+		db:     db,
+		wake:   make(chan struct{}, 1),
+		done:   make(chan struct{}),
+	}
+	q.producer = producer{q}
+	return q, nil
+}
+
+// enqueue stores a job and wakes an idle worker
+func (q *LocalQueue) enqueue(jobType string, args []byte, runAt time.Time) error {
+	if runAt.IsZero() {
+		runAt = time.Now()
+	}
+	if _, err := q.db.Exec(sqlEnqueueLocalJob, jobType, string(args), runAt.UnixNano()); err != nil {
+		return err
+	}
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// InitWorkerPool sets the number of workers StartWorkers starts
+func (q *LocalQueue) InitWorkerPool(numWorkers int) {
+	q.numWorkers = numWorkers
+}
+
+// StartWorkers starts the workers in the background
+func (q *LocalQueue) StartWorkers() {
+	go reapLoop(q.done, q.state.reap)
+	handlers := q.workMap()
+	for i := 0; i < q.numWorkers; i++ {
+		q.wg.Add(1)
+		go q.work(handlers)
+	}
+}
+
+// Close waits for the running jobs to finish and closes the database
+func (q *LocalQueue) Close() {
+	close(q.done)
+	q.wg.Wait()
+	q.db.Close()
+}
+
+func (q *LocalQueue) work(handlers map[string]func(job) error) {
+	defer q.wg.Done()
+	for {
+		select {
+		case <-q.done:
+			return
+		default:
+		}
+		ran, err := q.workOne(handlers)
+		if err != nil {
+			slog.Error("unable to run local job", "error", err)
+		}
+		if ran {
+			continue
+		}
+		select {
+		case <-q.done:
+			return
+		case <-q.wake:
+		case <-time.After(localPollInterval):
+		}
+	}
+}
+
+// workOne runs the next due job, reporting whether there was one. Failed
+// jobs are retried with the backoff que uses.
+func (q *LocalQueue) workOne(handlers map[string]func(job) error) (bool, error) {
+	var j job
+	var args string
+	err := q.db.QueryRow(sqlClaimLocalJob, time.Now().UnixNano()).Scan(&j.ID, &j.Type, &args, &j.ErrorCount)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	j.Args = []byte(args)
+	if err := runLocalJob(handlers, j); err != nil {
+		delay := time.Duration(intPow(j.ErrorCount+1, 4)+3) * time.Second
+		slog.Info("job retry scheduled", "job_id", j.ID, "type", j.Type, "retry_in", delay.String())
+		_, err = q.db.Exec(sqlRetryLocalJob, err.Error(), time.Now().Add(delay).UnixNano(), j.ID)
+		return true, err
+	}
+	_, err = q.db.Exec(sqlFinishLocalJob, j.ID)
+	return true, err
+}
+
+// runLocalJob runs a job, turning a panic into an error like que does
+func runLocalJob(handlers map[string]func(job) error, j job) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	work, ok := handlers[j.Type]
+	if !ok {
+		return fmt.Errorf("unknown job type %q", j.Type)
+	}
+	return work(j)
+}
+
+func intPow(x, y int) int {
+	r := 1
+	for i := 0; i < y; i++ {
+		r *= x
+	}
+	return r
+}
+
+// PendingRetentionPolicy reports whether a run of the policy is still queued
+// or running
+func (q *LocalQueue) PendingRetentionPolicy(policyID uint) (bool, error) {
+	var pending bool
+	err := q.db.QueryRow(sqlLocalPendingRetention, RetentionPolicyJob, policyID).Scan(&pending)
+	return pending, err
+}
+
+// UserJobs lists the cleanup and delayed delete jobs of a user of a
+// workspace in the order the workers will pick them up
+func (q *LocalQueue) UserJobs(teamID, userID string) ([]JobStatus, error) {
+	classes := []string{CleanChannelJob, RetentionPolicyJob, DelayedDeleteJob}
+	query := fmt.Sprintf(sqlLocalUserJobs, placeholders(len(classes)))
+	params := []interface{}{time.Now().UnixNano()}
+	params = append(params, stringArgs(classes)...)
+	params = append(params, teamID, userID)
+	rows, err := q.db.Query(query, params...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []JobStatus
+	for rows.Next() {
+		var s JobStatus
+		var args string
+		var runAt int64
+		var position int
+		if err := rows.Scan(&s.ID, &s.Type, &args, &runAt, &s.ErrorCount, &s.LastError, &s.Running, &position); err != nil {
+			return nil, err
+		}
+		s.RunAt = time.Unix(0, runAt)
+		if !s.Running && !s.Scheduled() {
+			s.Position = position
+		}
+		s.LastError = firstLine(s.LastError)
+		if err := s.decodeArgs([]byte(args)); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, s)
+	}
+	return jobs, rows.Err()
+}
+
+// Backlog counts the jobs of every type and how long the oldest due one has
+// been waiting
+func (q *LocalQueue) Backlog() ([]metrics.Backlog, error) {
+	rows, err := q.db.Query(sqlLocalBacklog, time.Now().UnixNano())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	backlog := make(map[string]metrics.Backlog)
+	for rows.Next() {
+		var b metrics.Backlog
+		var age int64
+		if err := rows.Scan(&b.Type, &b.Depth, &age); err != nil {
+			return nil, err
+		}
+		b.OldestDue = time.Duration(age)
+		backlog[b.Type] = b
+	}
+	return backlogList(backlog), rows.Err()
+}
+
+// CancelCleanChannel removes the queued cleanups and retention runs of a
+// user in a channel and asks running ones to stop after their current
+// deletion. A nonce limits it to the single cleanup enqueued with it.
+func (q *LocalQueue) CancelCleanChannel(userID, channel, nonce string) (CancelResult, error) {
+	var res CancelResult
+	tx, err := q.db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	now := time.Now().UnixNano()
+	params := append(stringArgs(cancellableJobs), userID, channel, nonce, nonce)
+	rows, err := tx.Query(fmt.Sprintf(sqlLocalDequeueCleanups, placeholders(len(cancellableJobs))), params...)
+	if err != nil {
+		return res, err
+	}
+	var dequeued []int64
+	for rows.Next() {
+		var id int64
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return res, err
+		}
+		dequeued = append(dequeued, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return res, err
+	}
+	for _, id := range dequeued {
+		if _, err := tx.Exec(sqlLocalRecordDequeued, id, userID, channel, now, now); err != nil {
+			return res, err
+		}
+	}
+	res.Dequeued = len(dequeued)
+
+	query := fmt.Sprintf(sqlLocalRequestCancellation, placeholders(len(cancellableJobs)),
+		"json_extract(args, '$.user_id') = ? AND json_extract(args, '$.channel_id') = ? AND (? = '' OR json_extract(args, '$.nonce') = ?)")
+	params = append([]interface{}{now}, params...)
+	result, err := tx.Exec(query, params...)
+	if err != nil {
+		return res, err
+	}
+	stopping, err := result.RowsAffected()
+	if err != nil {
+		return res, err
+	}
+	res.Stopping = int(stopping)
+	return res, tx.Commit()
+}
+
+// CancelRevokedJobs removes every queued job of the users of a workspace
+// whose tokens were revoked and stops their running cleanups. Without
+// userIDs the jobs of the whole workspace are cancelled.
+func (q *LocalQueue) CancelRevokedJobs(teamID string, userIDs []string) (int, error) {
+	tx, err := q.db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	match := "json_extract(args, '$.team_id') = ?"
+	params := []interface{}{teamID}
+	if len(userIDs) > 0 {
+		match += fmt.Sprintf(" AND json_extract(args, '$.user_id') IN (%s)", placeholders(len(userIDs)))
+		params = append(params, stringArgs(userIDs)...)
+	}
+	result, err := tx.Exec(fmt.Sprintf(sqlLocalDequeueRevoked, match), params...)
+	if err != nil {
+		return 0, err
+	}
+	dequeued, err := result.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	stopParams := append([]interface{}{time.Now().UnixNano()}, stringArgs(cancellableJobs)...)
+	stopParams = append(stopParams, params...)
+	if _, err := tx.Exec(fmt.Sprintf(sqlLocalRequestCancellation, placeholders(len(cancellableJobs)), match), stopParams...); err != nil {
+		return 0, err
+	}
+	return int(dequeued), tx.Commit()
+}
+
+// AuditLog returns the audit entries matching the query, newest first
+func (q *LocalQueue) AuditLog(query AuditQuery) ([]AuditEntry, error) {
+	var since int64
+	if !query.Since.IsZero() {
+		since = query.Since.UnixNano()
+	}
+	rows, err := q.db.Query(sqlLocalAuditLog, query.TeamID, query.UserID, query.Channel, since, query.Limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var entries []AuditEntry
+	for rows.Next() {
+		var e AuditEntry
+		var attemptedAt int64
+		if err := rows.Scan(&e.ID, &e.TeamID, &e.UserID, &e.Channel, &e.Timestamp, &e.FileID, &e.Category,
+			&e.ContentHash, &e.JobID, &e.Outcome, &e.SlackError, &attemptedAt); err != nil {
+			return nil, err
+		}
+		e.AttemptedAt = time.Unix(0, attemptedAt)
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+// localState keeps checkpoints, cancellations and the audit log in the
+// SQLite database of a LocalQueue
+type localState struct {
+	db     *sql.DB
+	worker string
+}
+
+// Acquire takes the lease of a job over for a new run, renewing its
+// heartbeat, and returns the checkpoint saved by earlier runs
+func (s localState) Acquire(jobID int64) (Checkpoint, error) {
+	lease, err := newLease(s.worker)
+	if err != nil {
+		return Checkpoint{}, err
+	}
+	cp := Checkpoint{Lease: lease}
+	err = s.db.QueryRow(sqlLocalAcquireCheckpoint, jobID, lease, time.Now().UnixNano()).Scan(&cp.HistoryLatest, &cp.MessagesDone, &cp.Kept,
+		&cp.ScannedMessages, &cp.DeletedMessages, &cp.DeletedFiles)
+	return cp, err
+}
+
+// Save persists the checkpoint and renews the job lease. It fails with
+// errLeaseLost once the job was rescheduled off this run.
+func (s localState) Save(jobID int64, cp Checkpoint) error {
+	result, err := s.db.Exec(sqlLocalSaveCheckpoint, cp.HistoryLatest, cp.MessagesDone, cp.Kept,
+		cp.ScannedMessages, cp.DeletedMessages, cp.DeletedFiles, time.Now().UnixNano(), jobID, cp.Lease)
+	if err != nil {
+		return err
+	}
+	saved, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if saved == 0 {
+		return errLeaseLost
+	}
+	return nil
+}
+
+// reap reschedules running jobs whose lease was not renewed for
+// leaseTimeout, a worker goroutine being stuck on them, and drops
+// checkpoints whose job no longer exists
+func (s localState) reap() error {
+	before := time.Now().Add(-leaseTimeout).UnixNano()
+	rows, err := s.db.Query(sqlLocalStaleCheckpoints, before)
+	if err != nil {
+		return err
+	}
+	var stale []staleLease
+	for rows.Next() {
+		var l staleLease
+		if err := rows.Scan(&l.jobID, &l.worker); err != nil {
+			rows.Close()
+			return err
+		}
+		stale = append(stale, l)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, l := range stale {
+		if err := s.requeue(l, before); err != nil {
+			return err
+		}
+	}
+	_, err = s.db.Exec(sqlLocalDeleteOrphanCheckpoints)
+	return err
+}
+
+// requeue moves a stuck job to a new id along with its checkpoint and
+// cancellation request. The stuck run finishing or failing later no longer
+// affects it.
+func (s localState) requeue(l staleLease, before int64) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	result, err := tx.Exec(sqlLocalRevokeLease, l.jobID, l.worker, before)
+	if err != nil {
+		return err
+	}
+	if revoked, err := result.RowsAffected(); err != nil || revoked == 0 {
+		return err
+	}
+	result, err = tx.Exec(sqlLocalRequeueJob, time.Now().UnixNano(), leaseExpiredError(l.worker), l.jobID)
+	if err != nil {
+		return err
+	}
+	if requeued, err := result.RowsAffected(); err != nil || requeued == 0 {
+		return err
+	}
+	newID, err := result.LastInsertId()
+	if err != nil {
+		return err
+	}
+	if _, err := tx.Exec(sqlFinishLocalJob, l.jobID); err != nil {
+		return err
+	}
+	for _, stmt := range []string{sqlLocalMoveCheckpoint, sqlLocalMoveCancellation} {
+		if _, err := tx.Exec(stmt, newID, l.jobID); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	slog.Warn("job lease expired, rescheduled", "job_id", l.jobID, "new_job_id", newID, "worker", l.worker)
+	return nil
+}
+
+func (s localState) Delete(jobID int64) error {
+	_, err := s.db.Exec(sqlLocalDeleteCheckpoint, jobID)
+	return err
+}
+
+func (s localState) cancelled(jobID int64) (bool, error) {
+	var requested bool
+	err := s.db.QueryRow(sqlLocalCancellationRequested, jobID).Scan(&requested)
+	return requested, err
+}
+
+func (s localState) stopped(jobID int64, historyLatest string, deletedMessages, deletedFiles int) error {
+	_, err := s.db.Exec(sqlLocalRecordStopped, time.Now().UnixNano(), historyLatest, deletedMessages, deletedFiles, jobID)
+	return err
+}
+
+func (s localState) record(e AuditEntry) error {
+	_, err := s.db.Exec(sqlLocalRecordDeletion, e.TeamID, e.UserID, e.Channel, e.Timestamp, e.FileID,
+		e.Category, e.ContentHash, e.JobID, e.Outcome, e.SlackError, e.AttemptedAt.UnixNano())
+	return err
+}
+
+func placeholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+func stringArgs(values []string) []interface{} {
+	args := make([]interface{}, len(values))
+	for i, v := range values {
+		args[i] = v
+	}
+	return args
+}
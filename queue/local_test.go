@@ -0,0 +1,116 @@
+package queue
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReapReschedulesStaleLease(t *testing.T) {
+	q, err := NewLocalQueue(filepath.Join(t.TempDir(), "queue.db"), nil)
+	if err != nil {
+		t.Fatalf("NewLocalQueue: %v", err)
+	}
+	defer q.Close()
+	if err := q.enqueue(CleanChannelJob, []byte(`{"user_id":"U1","channel_id":"C1"}`), time.Time{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	// a worker claims the job and gets stuck after its first checkpoint
+	var stuck job
+	var args string
+	if err := q.db.QueryRow(sqlClaimLocalJob, time.Now().UnixNano()).Scan(&stuck.ID, &stuck.Type, &args, &stuck.ErrorCount); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	cp, err := q.state.Acquire(stuck.ID)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	cp.HistoryLatest = "1546300800.000100"
+	cp.Kept = 2
+	cp.ScannedMessages, cp.DeletedMessages, cp.DeletedFiles = 40, 30, 3
+	if err := q.state.Save(stuck.ID, cp); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	if _, err := q.CancelCleanChannel("U1", "C1", ""); err != nil {
+		t.Fatalf("CancelCleanChannel: %v", err)
+	}
+
+	// a lease within leaseTimeout is left alone
+	if err := q.state.reap(); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+	if err := q.state.Save(stuck.ID, cp); err != nil {
+		t.Fatalf("Save of a live lease: %v", err)
+	}
+
+	stale := time.Now().Add(-leaseTimeout - time.Second).UnixNano()
+	if _, err := q.db.Exec("UPDATE local_checkpoints SET heartbeat_at = ? WHERE job_id = ?", stale, stuck.ID); err != nil {
+		t.Fatalf("aging the heartbeat: %v", err)
+	}
+	if err := q.state.reap(); err != nil {
+		t.Fatalf("reap: %v", err)
+	}
+
+	var requeued job
+	var running bool
+	var lastError string
+	err = q.db.QueryRow("SELECT job_id, job_class, error_count, last_error, running FROM local_jobs").
+		Scan(&requeued.ID, &requeued.Type, &requeued.ErrorCount, &lastError, &running)
+	if err != nil {
+		t.Fatalf("reading the requeued job: %v", err)
+	}
+	if requeued.ID == stuck.ID || requeued.Type != CleanChannelJob || running {
+		t.Fatalf("requeued job = %+v running %v, want a new idle %s job", requeued, running, CleanChannelJob)
+	}
+	if requeued.ErrorCount != 1 || lastError == "" {
+		t.Errorf("requeued job error count %d last error %q, want the expired lease recorded", requeued.ErrorCount, lastError)
+	}
+
+	// the stuck run stops at its next save
+	if err := q.state.Save(stuck.ID, cp); err != errLeaseLost {
+		t.Errorf("Save of the stale lease = %v, want %v", err, errLeaseLost)
+	}
+	// the next run resumes from the checkpoint and keeps the cancellation
+	resumed, err := q.state.Acquire(requeued.ID)
+	if err != nil {
+		t.Fatalf("Acquire: %v", err)
+	}
+	if resumed.HistoryLatest != cp.HistoryLatest || resumed.Kept != cp.Kept ||
+		resumed.ScannedMessages != cp.ScannedMessages || resumed.DeletedMessages != cp.DeletedMessages || resumed.DeletedFiles != cp.DeletedFiles {
+		t.Errorf("resumed checkpoint = %+v, want the cursor and counts of %+v", resumed, cp)
+	}
+	if cancelled, err := q.state.cancelled(requeued.ID); err != nil || !cancelled {
+		t.Errorf("cancelled(%d) = %v, %v, want the cancellation to follow the job", requeued.ID, cancelled, err)
+	}
+}
+
+func TestSettleClosesCancellation(t *testing.T) {
+	q, err := NewLocalQueue(":memory:", nil)
+	if err != nil {
+		t.Fatalf("NewLocalQueue: %v", err)
+	}
+	defer q.Close()
+	if err := q.enqueue(CleanChannelJob, []byte(`{"user_id":"U1","channel_id":"C1"}`), time.Time{}); err != nil {
+		t.Fatalf("enqueue: %v", err)
+	}
+	var j job
+	var args string
+	if err := q.db.QueryRow(sqlClaimLocalJob, time.Now().UnixNano()).Scan(&j.ID, &j.Type, &args, &j.ErrorCount); err != nil {
+		t.Fatalf("claim: %v", err)
+	}
+	// the job finishes without checking for the cancellation
+	res, err := q.CancelCleanChannel("U1", "C1", "")
+	if err != nil || res.Stopping != 1 {
+		t.Fatalf("CancelCleanChannel = %+v, %v, want the running job asked to stop", res, err)
+	}
+	if err := q.settle(func(job) error { return nil })(j); err != nil {
+		t.Fatalf("settle: %v", err)
+	}
+	var open int
+	if err := q.db.QueryRow("SELECT count(*) FROM local_cancellations WHERE stopped_at IS NULL").Scan(&open); err != nil {
+		t.Fatalf("counting open cancellations: %v", err)
+	}
+	if open != 0 {
+		t.Errorf("%d cancellations left open, want none", open)
+	}
+}
@@ -0,0 +1,180 @@
+package queue
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// responseURLWindow is how long after the command Slack accepts posts to its
+// response_url
+var responseURLWindow = 30 * time.Minute
+
+// progressSchedule is when, measured from when the cleanup was requested,
+// progress updates are sent. Slack accepts only five posts to a response_url
+// within responseURLWindow, so four are spent on progress and the last one is
+// kept for the final result.
+var progressSchedule = []time.Duration{
+	30 * time.Second,
+	2 * time.Minute,
+	6 * time.Minute,
+	15 * time.Minute,
+}
+
+// cleanupProgress tracks a running cleanup and reports it to the user
+type cleanupProgress struct {
+	channel     string
+	responseURL string
+	dryRun      bool
+	requested   time.Time
+	started     time.Time
+	sent        int
+	// archiveURL links the uploaded archive once the cleanup is done
+	archiveURL string
+
+	// newest and oldest bound the history being walked, position is the
+	// message currently being processed
+	newest   time.Time
+	oldest   time.Time
+	position time.Time
+	// phaseStarted, filePage and filePages track the files phase
+	phaseStarted time.Time
+	filePage     int
+	filePages    int
+
+	ScannedMessages int
+	DeletedMessages int
+	ScannedFiles    int
+	DeletedFiles    int
+}
+
+func newCleanupProgress(req CleanChannelRequest, now time.Time) *cleanupProgress {
+	requested := req.EnqueuedAt
+	if requested.IsZero() {
+		requested = now
+	}
+	return &cleanupProgress{
+		channel:      req.Channel,
+		responseURL:  req.ResponseURL,
+		dryRun:       req.Options.DryRun,
+		requested:    requested,
+		started:      now,
+		phaseStarted: now,
+		newest:       now,
+	}
+}
+
+// resume carries the counters of earlier runs of the job over. Files are
+// listed again from the first page, so only the deleted ones are counted.
+func (p *cleanupProgress) resume(cp Checkpoint) {
+	p.ScannedMessages = cp.ScannedMessages
+	p.DeletedMessages = cp.DeletedMessages
+	p.DeletedFiles = cp.DeletedFiles
+}
+
+// startFiles marks the switch from walking history to listing files
+func (p *cleanupProgress) startFiles() {
+	p.phaseStarted = time.Now()
+	p.position = time.Time{}
+}
+
+// responseURLExpired reports whether Slack stopped accepting posts to the
+// response_url of the cleanup
+func (p *cleanupProgress) responseURLExpired() bool {
+	return time.Since(p.requested) >= responseURLWindow
+}
+
+// report sends an update when the next slot of the schedule is due
+func (p *cleanupProgress) report() error {
+	if p.responseURL == "" || p.sent >= len(progressSchedule) || p.responseURLExpired() {
+		return nil
+	}
+	elapsed := time.Since(p.requested)
+	if elapsed < progressSchedule[p.sent] {
+		return nil
+	}
+	// slots that passed while the job waited in the queue are skipped
+	for p.sent < len(progressSchedule) && elapsed >= progressSchedule[p.sent] {
+		p.sent++
+	}
+	return Respond(p.responseURL, p.Message())
+}
+
+// fraction estimates how much of the current phase is done
+func (p *cleanupProgress) fraction() float64 {
+	if !p.position.IsZero() && !p.oldest.IsZero() && p.newest.After(p.oldest) {
+		return float64(p.newest.Sub(p.position)) / float64(p.newest.Sub(p.oldest))
+	}
+	if p.filePages > 0 {
+		return float64(p.filePage-1) / float64(p.filePages)
+	}
+	return 0
+}
+
+// eta estimates the time left in the current phase
+func (p *cleanupProgress) eta() (time.Duration, bool) {
+	f := p.fraction()
+	if f < 0.01 || f >= 1 {
+		return 0, false
+	}
+	elapsed := time.Since(p.phaseStarted)
+	return time.Duration(float64(elapsed) * (1 - f) / f), true
+}
+
+// Message renders the current progress
+func (p *cleanupProgress) Message() slack.Msg {
+	verb := "deleted"
+	if p.dryRun {
+		verb = "matched"
+	}
+	lines := []string{fmt.Sprintf("Cleaning <#%s>: scanned %d messages (%s %d) and %d files (%s %d).",
+		p.channel, p.ScannedMessages, verb, p.DeletedMessages, p.ScannedFiles, verb, p.DeletedFiles)}
+	if !p.position.IsZero() {
+		lines = append(lines, "Currently at messages from "+p.position.UTC().Format("Jan 2, 2006")+".")
+	} else if p.filePages > 0 {
+		lines = append(lines, fmt.Sprintf("Currently at page %d of %d of files.", p.filePage, p.filePages))
+	}
+	if eta, ok := p.eta(); ok {
+		lines = append(lines, "About "+eta.Round(time.Minute).String()+" remaining in this phase.")
+	}
+	return slack.Msg{
+		ResponseType:    "ephemeral",
+		ReplaceOriginal: true,
+		Text:            strings.Join(lines, "\n"),
+	}
+}
+
+// Finished renders the final result of a cleanup
+func (p *cleanupProgress) Finished() slack.Msg {
+	text := fmt.Sprintf("Cleanup of <#%s> finished: deleted %d messages and %d files in %s.",
+		p.channel, p.DeletedMessages, p.DeletedFiles, time.Since(p.started).Round(time.Second))
+	return slack.Msg{
+		ResponseType:    "ephemeral",
+		ReplaceOriginal: true,
+		Text:            text + p.archiveLink(),
+	}
+}
+
+// Cancelled renders the result of a cancelled cleanup
+func (p *cleanupProgress) Cancelled() slack.Msg {
+	text := fmt.Sprintf("Cleanup of <#%s> cancelled after deleting %d messages and %d files.",
+		p.channel, p.DeletedMessages, p.DeletedFiles)
+	if !p.position.IsZero() {
+		text += " It stopped at messages from " + p.position.UTC().Format("Jan 2, 2006") + "."
+	}
+	return slack.Msg{
+		ResponseType:    "ephemeral",
+		ReplaceOriginal: true,
+		Text:            text + p.archiveLink(),
+	}
+}
+
+// archiveLink points at the uploaded archive, if there is one
+func (p *cleanupProgress) archiveLink() string {
+	if p.archiveURL == "" {
+		return ""
+	}
+	return "\n<" + p.archiveURL + "|Download the archive> of everything that was deleted, it is only visible to you."
+}
@@ -1,12 +1,16 @@
 package queue
 
 import (
-	"encoding/json"
+	"context"
+	"fmt"
 	"net/url"
 	"time"
 
 	que "github.com/bgentry/que-go"
 	"github.com/jackc/pgx"
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/king-jam/channel-cleaner/metrics"
 )
 
 var (
@@ -14,50 +18,139 @@ var (
 	CleanChannelJob = "CleanChannelRequests"
 	// DelayedDeleteJob describes delayed delete requests
 	DelayedDeleteJob = "DelayedDeleteRequests"
+	// RetentionPolicyJob describes scheduled retention policy runs
+	RetentionPolicyJob = "RetentionPolicyRequests"
 )
 
+// jobTypes lists every job type
+var jobTypes = []string{CleanChannelJob, DelayedDeleteJob, RetentionPolicyJob}
+
+// TokenSource looks up the stored token of the user a job runs for. Jobs
+// only carry the IDs of the user, never the token itself.
+type TokenSource interface {
+	GetTokenData(teamID, enterpriseID, userID string) (*backend.TokenData, error)
+}
+
 // DelayedDeleteRequest is the struct for doing a delayed delete
 type DelayedDeleteRequest struct {
-	Token     string `json:"token"`
-	Channel   string `json:"channel_id"`
-	Timestamp string `json:"ts"`
+	TeamID       string    `json:"team_id"`
+	EnterpriseID string    `json:"enterprise_id,omitempty"`
+	Channel      string    `json:"channel_id"`
+	UserID       string    `json:"user_id"`
+	Timestamp    string    `json:"ts"`
+	FileID       string    `json:"file_id,omitempty"`
+	EnqueuedAt   time.Time `json:"enqueued_at"`
+	RequestID    string    `json:"request_id,omitempty"`
 }
 
 // CleanChannelRequest is the struct for doing a channel cleanup
 type CleanChannelRequest struct {
-	Token   string           `json:"token"`
-	Channel string           `json:"channel_id"`
-	UserID  string           `json:"user_id"`
-	Options CleanChannelOpts `json:"command_options"`
+	TeamID       string           `json:"team_id"`
+	EnterpriseID string           `json:"enterprise_id,omitempty"`
+	Channel      string           `json:"channel_id"`
+	UserID       string           `json:"user_id"`
+	ResponseURL  string           `json:"response_url"`
+	Options      CleanChannelOpts `json:"command_options"`
+	EnqueuedAt   time.Time        `json:"enqueued_at"`
+	RequestID    string           `json:"request_id,omitempty"`
+	// Nonce identifies the cleanup to the Abort button of its prompt. On a
+	// dry run it names the pending cleanup the run previews for confirmation.
+	Nonce string `json:"nonce,omitempty"`
 }
 
 // Queue is a job queue to pass messages between the web thread and workers
-type Queue struct {
-	qc      *que.Client
-	pgxpool *pgx.ConnPool
-	wm      *que.WorkMap
-	workers *que.WorkerPool
+type Queue interface {
+	QueueCleanChannel(ctx context.Context, teamID, enterpriseID, channel, userID, responseURL, nonce string, options CleanChannelOpts, runAt time.Time) error
+	QueueDelayedDelete(ctx context.Context, teamID, enterpriseID, channel, userID, ts string, runAt time.Time) error
+	QueueDelayedFileDelete(ctx context.Context, teamID, enterpriseID, channel, userID, fileID string, runAt time.Time) error
+	QueueRetentionPolicy(ctx context.Context, policyID uint, teamID, enterpriseID, channel, userID string, options CleanChannelOpts) error
+	PendingRetentionPolicy(policyID uint) (bool, error)
+	CancelCleanChannel(userID, channel, nonce string) (CancelResult, error)
+	CancelRevokedJobs(teamID string, userIDs []string) (int, error)
+	TestToken(token, teamID string) error
+	UserJobs(teamID, userID string) ([]JobStatus, error)
+	AuditLog(query AuditQuery) ([]AuditEntry, error)
+	Backlog() ([]metrics.Backlog, error)
+	SetArchiveDir(dir string)
+	InitWorkerPool(numWorkers int)
+	StartWorkers()
+	Close()
+}
+
+var (
+	_ Queue = (*PGQueue)(nil)
+	_ Queue = (*LocalQueue)(nil)
+)
+
+// Open connects to the Queue selected by the scheme of the URL: postgres://
+// for que-go, sqlite: for an in-process queue persisted to a SQLite file and
+// memory: for an in-process queue that is lost on restart
+func Open(u *url.URL, tokens TokenSource) (Queue, error) {
+	switch u.Scheme {
+	case "postgres", "postgresql":
+		return NewPGQueue(u, tokens)
+	case "sqlite", "sqlite3":
+		return NewLocalQueue(backend.SQLitePath(u), tokens)
+	case "memory":
+		return NewLocalQueue(":memory:", tokens)
+	}
+	return nil, fmt.Errorf("unsupported queue scheme %q", u.Scheme)
 }
 
-// NewQueue initializes and creates a new message passing queue
-func NewQueue(dbURL *url.URL) (*Queue, error) {
+// PGQueue is a Queue backed by que-go on Postgres, shared by every dyno
+type PGQueue struct {
+	*runner
+	producer
+	qc          *que.Client
+	pgxpool     *pgx.ConnPool
+	wm          *que.WorkMap
+	workers     *que.WorkerPool
+	checkpoints *checkpointStore
+	done        chan struct{}
+}
+
+// NewPGQueue initializes and creates a new message passing queue
+func NewPGQueue(dbURL *url.URL, tokens TokenSource) (*PGQueue, error) {
 	pgxpool, qc, err := setupDB(dbURL.String())
 	if err != nil {
 		return nil, err
 	}
-	wm := &que.WorkMap{
-		DelayedDeleteJob: delayedDelete,
-		CleanChannelJob:  cleanChannel,
+	checkpoints := newCheckpointStore(pgxpool)
+	q := &PGQueue{
+		runner:      newRunner(checkpoints, pgAuditLog{pgxpool}, tokens),
+		qc:          qc,
+		pgxpool:     pgxpool,
+		checkpoints: checkpoints,
+		done:        make(chan struct{}),
+	}
+	q.producer = producer{q}
+	q.wm = &que.WorkMap{}
+	for jobType, work := range q.workMap() {
+		(*q.wm)[jobType] = queWork(work)
+	}
+	return q, nil
+}
+
+// queWork adapts a job handler to que
+func queWork(work func(job) error) que.WorkFunc {
+	return func(j *que.Job) error {
+		return work(job{ID: j.ID, Type: j.Type, Args: j.Args, ErrorCount: int(j.ErrorCount)})
+	}
+}
+
+// enqueue stores a job for the que workers
+func (q *PGQueue) enqueue(jobType string, args []byte, runAt time.Time) error {
+	j := que.Job{
+		Type:  jobType,
+		Args:  args,
+		RunAt: runAt,
 	}
-	return &Queue{
-		qc:      qc,
-		pgxpool: pgxpool,
-		wm:      wm,
-	}, nil
+	return q.qc.Enqueue(&j)
 }
 
 // Close cleanups up the queue
-func (q *Queue) Close() {
+func (q *PGQueue) Close() {
+	close(q.done)
 	if q.workers != nil {
 		q.workers.Shutdown()
 	}
@@ -66,46 +159,53 @@ func (q *Queue) Close() {
 	}
 }
 
-// QueueCleanChannel enqueues a cleanup channel job
-func (q *Queue) QueueCleanChannel(token, channel, userID string, options CleanChannelOpts) error {
+// QueueCleanChannel enqueues a cleanup channel job to run at runAt, or right
+// away when runAt is zero. A nonce lets CancelCleanChannel single it out.
+func (p producer) QueueCleanChannel(ctx context.Context, teamID, enterpriseID, channel, userID, responseURL, nonce string, options CleanChannelOpts, runAt time.Time) error {
 	req := CleanChannelRequest{
-		Token:   token,
-		Channel: channel,
-		UserID:  userID,
-		Options: options,
+		TeamID:       teamID,
+		EnterpriseID: enterpriseID,
+		Channel:      channel,
+		UserID:       userID,
+		ResponseURL:  responseURL,
+		Nonce:        nonce,
+		Options:      options,
+		EnqueuedAt:   time.Now(),
+		RequestID:    logging.RequestID(ctx),
 	}
-	args, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-	j := que.Job{
-		Type: CleanChannelJob,
-		Args: args,
-	}
-	return q.qc.Enqueue(&j)
+	return p.enqueueRequest(CleanChannelJob, req, runAt)
 }
 
 // QueueDelayedDelete enqueues a delayed message delete job
-func (q *Queue) QueueDelayedDelete(token, channel, ts string, runAt time.Time) error {
+func (p producer) QueueDelayedDelete(ctx context.Context, teamID, enterpriseID, channel, userID, ts string, runAt time.Time) error {
 	req := DelayedDeleteRequest{
-		Token:     token,
-		Channel:   channel,
-		Timestamp: ts,
+		TeamID:       teamID,
+		EnterpriseID: enterpriseID,
+		Channel:      channel,
+		UserID:       userID,
+		Timestamp:    ts,
+		EnqueuedAt:   time.Now(),
+		RequestID:    logging.RequestID(ctx),
 	}
-	args, err := json.Marshal(req)
-	if err != nil {
-		return err
-	}
-	j := que.Job{
-		Type:  DelayedDeleteJob,
-		Args:  args,
-		RunAt: runAt,
+	return p.enqueueRequest(DelayedDeleteJob, req, runAt)
+}
+
+// QueueDelayedFileDelete enqueues a delayed file delete job
+func (p producer) QueueDelayedFileDelete(ctx context.Context, teamID, enterpriseID, channel, userID, fileID string, runAt time.Time) error {
+	req := DelayedDeleteRequest{
+		TeamID:       teamID,
+		EnterpriseID: enterpriseID,
+		Channel:      channel,
+		UserID:       userID,
+		FileID:       fileID,
+		EnqueuedAt:   time.Now(),
+		RequestID:    logging.RequestID(ctx),
 	}
-	return q.qc.Enqueue(&j)
+	return p.enqueueRequest(DelayedDeleteJob, req, runAt)
 }
 
 // InitWorkerPool initializes a worker pool to do work
-func (q *Queue) InitWorkerPool(numWorkers int) {
+func (q *PGQueue) InitWorkerPool(numWorkers int) {
 	if q.wm == nil {
 		return
 	}
@@ -113,8 +213,9 @@ func (q *Queue) InitWorkerPool(numWorkers int) {
 }
 
 // StartWorkers starts up the worker pool
-func (q *Queue) StartWorkers() {
+func (q *PGQueue) StartWorkers() {
 	if q.workers != nil {
+		go reapLoop(q.done, q.checkpoints.reap)
 		q.workers.Start()
 	}
 }
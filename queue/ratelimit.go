@@ -0,0 +1,306 @@
+package queue
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/nlopes/slack"
+)
+
+// tier is a Slack Web API rate limit tier, see
+// https://api.slack.com/docs/rate-limits
+type tier int
+
+const (
+	tier1 tier = iota + 1
+	tier2
+	tier3
+	tier4
+)
+
+// tierPerMinute is the documented minimum number of calls per minute for
+// each tier. Slack tolerates bursts above it, which the limiter probes for.
+var tierPerMinute = map[tier]int{
+	tier1: 1,
+	tier2: 20,
+	tier3: 50,
+	tier4: 100,
+}
+
+// methodTiers maps the Slack methods the workers call onto their tier
+var methodTiers = map[string]tier{
+	"auth.test":             tier4,
+	"chat.delete":           tier3,
+	"conversations.history": tier3,
+	"conversations.info":    tier3,
+	"conversations.replies": tier3,
+	"files.list":            tier3,
+	"files.delete":          tier3,
+	"files.upload":          tier2,
+	"chat.postMessage":      tier3,
+	"users.info":            tier4,
+}
+
+var (
+	// maxSpeedup caps how far above the documented tier rate a bucket may go
+	maxSpeedup = 4
+	// speedupStep shortens a bucket interval after every successful call
+	speedupStep = 0.02
+	// maxRateLimitRetries bounds how often a single call is retried on 429
+	maxRateLimitRetries = 5
+	// bucketIdle is how long a bucket is kept after its last call. Every
+	// token gets buckets of its own, which would otherwise pile up forever.
+	bucketIdle = 30 * time.Minute
+)
+
+// bucket paces calls to one method for one key. The interval adapts: it
+// shrinks a little after every success and doubles when Slack answers 429.
+type bucket struct {
+	next         time.Time
+	blockedUntil time.Time
+	usedAt       time.Time
+	interval     time.Duration
+	minInterval  time.Duration
+	maxInterval  time.Duration
+}
+
+// rateLimiter shares Slack API budget between all workers of the process,
+// keyed per method and per token and team
+type rateLimiter struct {
+	mu       sync.Mutex
+	buckets  map[string]*bucket
+	prunedAt time.Time
+}
+
+func newRateLimiter() *rateLimiter {
+	return &rateLimiter{
+		buckets: make(map[string]*bucket),
+	}
+}
+
+// prune drops the buckets unused for bucketIdle, at most once per bucketIdle.
+// A bucket still blocked or paced past its idle time is kept, dropping it
+// would let the next call through too early.
+func (l *rateLimiter) prune(now time.Time) {
+	if now.Sub(l.prunedAt) < bucketIdle {
+		return
+	}
+	l.prunedAt = now
+	for k, b := range l.buckets {
+		if now.Sub(b.usedAt) >= bucketIdle && now.After(b.next) && now.After(b.blockedUntil) {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+func (l *rateLimiter) bucket(key, method string) *bucket {
+	k := key + "/" + method
+	b, ok := l.buckets[k]
+	if !ok {
+		t, ok := methodTiers[method]
+		if !ok {
+			t = tier2
+		}
+		base := time.Minute / time.Duration(tierPerMinute[t])
+		b = &bucket{
+			interval:    base,
+			minInterval: base / time.Duration(maxSpeedup),
+			maxInterval: base * 16,
+		}
+		l.buckets[k] = b
+	}
+	return b
+}
+
+// reserve claims the next slot in every bucket and returns how long the
+// caller has to wait for it
+func (l *rateLimiter) reserve(keys []string, method string) time.Duration {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	l.prune(now)
+	at := now
+	for _, key := range keys {
+		b := l.bucket(key, method)
+		b.usedAt = now
+		if b.next.After(at) {
+			at = b.next
+		}
+		if b.blockedUntil.After(at) {
+			at = b.blockedUntil
+		}
+	}
+	for _, key := range keys {
+		b := l.bucket(key, method)
+		b.next = at.Add(b.interval)
+	}
+	return at.Sub(now)
+}
+
+// success speeds up the buckets a little
+func (l *rateLimiter) success(keys []string, method string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, key := range keys {
+		b := l.bucket(key, method)
+		b.interval -= time.Duration(float64(b.interval) * speedupStep)
+		if b.interval < b.minInterval {
+			b.interval = b.minInterval
+		}
+	}
+}
+
+// limited blocks the buckets for retryAfter and halves their rate
+func (l *rateLimiter) limited(keys []string, method string, retryAfter time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	until := time.Now().Add(retryAfter)
+	for _, key := range keys {
+		b := l.bucket(key, method)
+		if until.After(b.blockedUntil) {
+			b.blockedUntil = until
+		}
+		b.interval *= 2
+		if b.interval > b.maxInterval {
+			b.interval = b.maxInterval
+		}
+	}
+}
+
+// do runs call within the budget of method, retrying when Slack responds
+// with a rate limit error
+func (l *rateLimiter) do(keys []string, method string, call func() error) error {
+	for attempt := 0; ; attempt++ {
+		if wait := l.reserve(keys, method); wait > 0 {
+			time.Sleep(wait)
+		}
+		err := call()
+		rle, ok := err.(*slack.RateLimitedError)
+		if !ok {
+			if err == nil {
+				l.success(keys, method)
+			}
+			return err
+		}
+		if attempt >= maxRateLimitRetries {
+			return err
+		}
+		l.limited(keys, method, rle.RetryAfter)
+	}
+}
+
+// limiterKeys returns the budget keys for a token and the team it belongs
+// to. Tokens are hashed so they never sit in memory as map keys.
+func limiterKeys(token, teamID string) []string {
+	sum := sha256.Sum256([]byte(token))
+	keys := []string{"token:" + hex.EncodeToString(sum[:8])}
+	if teamID != "" {
+		keys = append(keys, "team:"+teamID)
+	}
+	return keys
+}
+
+// limitedClient wraps the Slack methods used by the workers with the shared
+// rate limiter
+type limitedClient struct {
+	api     *slack.Client
+	limiter *rateLimiter
+	keys    []string
+}
+
+func (l *rateLimiter) client(token, teamID string) *limitedClient {
+	return &limitedClient{
+		api:     slack.New(token, metrics.SlackClient),
+		limiter: l,
+		keys:    limiterKeys(token, teamID),
+	}
+}
+
+// GetConversationHistory calls conversations.history
+func (c *limitedClient) GetConversationHistory(params *slack.GetConversationHistoryParameters) (history *slack.GetConversationHistoryResponse, err error) {
+	err = c.limiter.do(c.keys, "conversations.history", func() error {
+		history, err = c.api.GetConversationHistory(params)
+		return err
+	})
+	return history, err
+}
+
+// GetConversationInfo calls conversations.info
+func (c *limitedClient) GetConversationInfo(channelID string) (channel *slack.Channel, err error) {
+	err = c.limiter.do(c.keys, "conversations.info", func() error {
+		channel, err = c.api.GetConversationInfo(channelID, false)
+		return err
+	})
+	return channel, err
+}
+
+// GetConversationReplies calls conversations.replies
+func (c *limitedClient) GetConversationReplies(params *slack.GetConversationRepliesParameters) (msgs []slack.Message, hasMore bool, nextCursor string, err error) {
+	err = c.limiter.do(c.keys, "conversations.replies", func() error {
+		msgs, hasMore, nextCursor, err = c.api.GetConversationReplies(params)
+		return err
+	})
+	return msgs, hasMore, nextCursor, err
+}
+
+// GetFiles calls files.list
+func (c *limitedClient) GetFiles(params slack.GetFilesParameters) (files []slack.File, paging *slack.Paging, err error) {
+	err = c.limiter.do(c.keys, "files.list", func() error {
+		files, paging, err = c.api.GetFiles(params)
+		return err
+	})
+	return files, paging, err
+}
+
+// DeleteMessage calls chat.delete
+func (c *limitedClient) DeleteMessage(channel, ts string) (err error) {
+	return c.limiter.do(c.keys, "chat.delete", func() error {
+		_, _, err = c.api.DeleteMessage(channel, ts)
+		return err
+	})
+}
+
+// DeleteFile calls files.delete
+func (c *limitedClient) DeleteFile(fileID string) error {
+	return c.limiter.do(c.keys, "files.delete", func() error {
+		return c.api.DeleteFile(fileID)
+	})
+}
+
+// GetUserInfo calls users.info
+func (c *limitedClient) GetUserInfo(userID string) (user *slack.User, err error) {
+	err = c.limiter.do(c.keys, "users.info", func() error {
+		user, err = c.api.GetUserInfo(userID)
+		return err
+	})
+	return user, err
+}
+
+// UploadFile calls files.upload
+func (c *limitedClient) UploadFile(params slack.FileUploadParameters) (file *slack.File, err error) {
+	err = c.limiter.do(c.keys, "files.upload", func() error {
+		file, err = c.api.UploadFile(params)
+		return err
+	})
+	return file, err
+}
+
+// AuthTest calls auth.test
+func (c *limitedClient) AuthTest() error {
+	return c.limiter.do(c.keys, "auth.test", func() error {
+		_, err := c.api.AuthTest()
+		return err
+	})
+}
+
+// PostMessage calls chat.postMessage as the user
+func (c *limitedClient) PostMessage(channel string, msg slack.Msg) error {
+	return c.limiter.do(c.keys, "chat.postMessage", func() error {
+		_, _, _, err := c.api.SendMessage(channel, slack.MsgOptionText(msg.Text, false),
+			slack.MsgOptionAttachments(msg.Attachments...), slack.MsgOptionAsUser(true))
+		return err
+	})
+}
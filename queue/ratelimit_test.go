@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiterPrunesIdleBuckets(t *testing.T) {
+	l := newRateLimiter()
+	idle := limiterKeys("idle token", "T1")
+	busy := limiterKeys("busy token", "T2")
+	blocked := limiterKeys("blocked token", "T3")
+	l.reserve(idle, "chat.delete")
+	l.reserve(busy, "chat.delete")
+	l.reserve(blocked, "chat.delete")
+	l.limited(blocked, "chat.delete", 2*bucketIdle)
+
+	// the idle and blocked buckets were last used long ago
+	past := time.Now().Add(-bucketIdle - time.Minute)
+	for _, keys := range [][]string{idle, blocked} {
+		for _, key := range keys {
+			b := l.bucket(key, "chat.delete")
+			b.usedAt, b.next = past, past
+		}
+	}
+	l.prunedAt = past
+	l.reserve(busy, "chat.delete")
+
+	for _, tt := range []struct {
+		name string
+		keys []string
+		kept bool
+	}{
+		{"idle", idle, false},
+		{"busy", busy, true},
+		{"blocked", blocked, true},
+	} {
+		for _, key := range tt.keys {
+			if _, ok := l.buckets[key+"/chat.delete"]; ok != tt.kept {
+				t.Errorf("%s bucket %s kept = %v, want %v", tt.name, key, ok, tt.kept)
+			}
+		}
+	}
+	if n := len(l.buckets); n != 4 {
+		t.Errorf("%d buckets left, want 4", n)
+	}
+}
@@ -0,0 +1,31 @@
+package queue
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/nlopes/slack"
+)
+
+// Respond posts a message back to the response_url of the slash command
+// or interaction that scheduled the job
+func Respond(responseURL string, msg slack.Msg) error {
+	if responseURL == "" {
+		return nil
+	}
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	resp, err := http.Post(responseURL, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("response_url returned %s", resp.Status)
+	}
+	return nil
+}
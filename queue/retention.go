@@ -0,0 +1,58 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/pkg/errors"
+)
+
+const sqlPendingRetention = `
+SELECT EXISTS (
+  SELECT 1 FROM que_jobs
+  WHERE job_class = $1
+    AND args->>'policy_id' = $2
+)`
+
+// RetentionPolicyRequest is the struct for applying a retention policy. It
+// is a cleanup of the policy channel tagged with the policy it came from.
+type RetentionPolicyRequest struct {
+	PolicyID uint `json:"policy_id"`
+	CleanChannelRequest
+}
+
+// QueueRetentionPolicy enqueues a run of a retention policy
+func (p producer) QueueRetentionPolicy(ctx context.Context, policyID uint, teamID, enterpriseID, channel, userID string, options CleanChannelOpts) error {
+	req := RetentionPolicyRequest{
+		PolicyID: policyID,
+		CleanChannelRequest: CleanChannelRequest{
+			TeamID:       teamID,
+			EnterpriseID: enterpriseID,
+			Channel:      channel,
+			UserID:       userID,
+			Options:      options,
+			EnqueuedAt:   time.Now(),
+			RequestID:    logging.RequestID(ctx),
+		},
+	}
+	return p.enqueueRequest(RetentionPolicyJob, req, time.Time{})
+}
+
+// PendingRetentionPolicy reports whether a run of the policy is still queued
+// or running, so the scheduler does not pile up runs
+func (q *PGQueue) PendingRetentionPolicy(policyID uint) (bool, error) {
+	var pending bool
+	err := q.pgxpool.QueryRow(sqlPendingRetention, RetentionPolicyJob, strconv.FormatUint(uint64(policyID), 10)).Scan(&pending)
+	return pending, err
+}
+
+func (r *runner) applyRetentionPolicy(j job) error {
+	var rpr RetentionPolicyRequest
+	if err := json.Unmarshal(j.Args, &rpr); err != nil {
+		return errors.Wrap(err, "Unable to unmarshal job arguments into RetentionPolicyRequest")
+	}
+	return r.runCleanup(j, rpr.CleanChannelRequest)
+}
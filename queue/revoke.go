@@ -0,0 +1,83 @@
+package queue
+
+import (
+	"log/slog"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	// queued jobs of the revoked users are removed outright, running ones
+	// are asked to stop like a cancelled cleanup. No users means every user
+	// of the workspace.
+	sqlDequeueRevoked = `
+DELETE FROM que_jobs
+WHERE args->>'team_id' = $1
+  AND (cardinality($2::text[]) = 0 OR args->>'user_id' = ANY($2))
+  AND job_id NOT IN (
+    SELECT (classid::bigint << 32) + objid::bigint
+    FROM pg_locks
+    WHERE locktype = 'advisory'
+  )`
+
+	sqlStopRevoked = `
+INSERT INTO cleanup_cancellations (job_id, user_id, channel_id)
+SELECT job_id, args->>'user_id', args->>'channel_id'
+FROM que_jobs
+WHERE job_class = ANY($1)
+  AND args->>'team_id' = $2
+  AND (cardinality($3::text[]) = 0 OR args->>'user_id' = ANY($3))
+ON CONFLICT (job_id) DO NOTHING`
+)
+
+// TokenRevoked reports whether Slack rejected a call because the token it was
+// made with no longer works
+func TokenRevoked(err error) bool {
+	if err == nil {
+		return false
+	}
+	if errors.Cause(err) == errTokenNotFound {
+		return true
+	}
+	switch errors.Cause(err).Error() {
+	case "invalid_auth", "not_authed", "token_revoked", "token_expired", "account_inactive":
+		return true
+	}
+	return false
+}
+
+// CancelRevokedJobs removes every queued job of the users of a workspace
+// whose tokens were revoked and stops their running cleanups. Without
+// userIDs the jobs of the whole workspace are cancelled.
+func (q *PGQueue) CancelRevokedJobs(teamID string, userIDs []string) (int, error) {
+	if userIDs == nil {
+		userIDs = []string{}
+	}
+	tx, err := q.pgxpool.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	tag, err := tx.Exec(sqlDequeueRevoked, teamID, userIDs)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(sqlStopRevoked, cancellableJobs, teamID, userIDs); err != nil {
+		return 0, err
+	}
+	return int(tag.RowsAffected()), tx.Commit()
+}
+
+// dropRevoked finishes jobs whose token was revoked instead of letting que
+// retry them forever
+func dropRevoked(f func(job) error) func(job) error {
+	return func(j job) error {
+		err := f(j)
+		if TokenRevoked(err) {
+			slog.Info("job dropped", "job_id", j.ID, "type", j.Type, "reason", err.Error())
+			return nil
+		}
+		return err
+	}
+}
@@ -0,0 +1,176 @@
+package queue
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/metrics"
+	"github.com/pkg/errors"
+)
+
+// job is a unit of work handed to a runner, whichever Queue stored it
+type job struct {
+	ID   int64
+	Type string
+	Args []byte
+	// ErrorCount is how many earlier runs of the job failed
+	ErrorCount int
+}
+
+// maxJobRetries is how often a failed job is retried before it is given up,
+// the default of que in Ruby. que-go itself retries forever.
+const maxJobRetries = 15
+
+// jobState persists the cursor and the cancellation requests of cleanup
+// jobs next to the jobs themselves
+type jobState interface {
+	Acquire(jobID int64) (Checkpoint, error)
+	Save(jobID int64, cp Checkpoint) error
+	Delete(jobID int64) error
+	cancelled(jobID int64) (bool, error)
+	stopped(jobID int64, historyLatest string, deletedMessages, deletedFiles int) error
+}
+
+// runner executes jobs. The Queue implementations share it and only differ
+// in how they store jobs and hand them out.
+type runner struct {
+	limiter     *rateLimiter
+	archiveRoot string
+	state       jobState
+	audit       auditLog
+	tokens      TokenSource
+}
+
+func newRunner(state jobState, audit auditLog, tokens TokenSource) *runner {
+	return &runner{
+		limiter:     newRateLimiter(),
+		archiveRoot: "archive",
+		state:       state,
+		audit:       audit,
+		tokens:      tokens,
+	}
+}
+
+// errTokenNotFound is returned when the user of a job uninstalled the app
+// or had the token purged before the job ran
+var errTokenNotFound = errors.New("token not found")
+
+// token loads and decrypts the access token of the user a job runs for
+func (r *runner) token(teamID, enterpriseID, userID string) (string, error) {
+	t, err := r.tokens.GetTokenData(teamID, enterpriseID, userID)
+	if err == backend.ErrRecordNotFound {
+		return "", errTokenNotFound
+	}
+	if err != nil {
+		return "", errors.Wrap(err, "Unable to load the token")
+	}
+	return t.AccessToken, nil
+}
+
+// TestToken checks a token with auth.test within the rate limit budget the
+// workers share, so a token sweep and the cleanups of a workspace stay within
+// its limits together
+func (r *runner) TestToken(token, teamID string) error {
+	return r.limiter.client(token, teamID).AuthTest()
+}
+
+// SetArchiveDir sets the directory cleanup archives are written under
+func (r *runner) SetArchiveDir(dir string) {
+	r.archiveRoot = dir
+}
+
+// workMap returns the handler of every job type
+func (r *runner) workMap() map[string]func(job) error {
+	return map[string]func(job) error{
+		DelayedDeleteJob:   r.giveUp(observed(dropRevoked(r.delayedDelete))),
+		CleanChannelJob:    r.settle(r.giveUp(observed(dropRevoked(r.cleanChannel)))),
+		RetentionPolicyJob: r.settle(r.giveUp(observed(dropRevoked(r.applyRetentionPolicy)))),
+	}
+}
+
+// jobFields are the arguments every request carries that identify a job in
+// the logs. The token is deliberately left out.
+type jobFields struct {
+	TeamID    string `json:"team_id"`
+	Channel   string `json:"channel_id"`
+	UserID    string `json:"user_id"`
+	RequestID string `json:"request_id"`
+}
+
+// observed logs and records the outcome and duration of every run of a job
+func observed(work func(job) error) func(job) error {
+	return func(j job) error {
+		var f jobFields
+		// a malformed job still runs and fails in its handler
+		_ = json.Unmarshal(j.Args, &f)
+		logger := slog.With("job_id", j.ID, "type", j.Type, "team_id", f.TeamID,
+			"channel_id", f.Channel, "user_id", f.UserID, "request_id", f.RequestID)
+		logger.Info("job started")
+		start := time.Now()
+		err := work(j)
+		took := time.Since(start)
+		metrics.ObserveJob(j.Type, took, err)
+		if err != nil {
+			logger.Error("job failed", "duration_ms", took.Milliseconds(), "error", firstLine(err.Error()))
+		} else {
+			logger.Info("job finished", "duration_ms", took.Milliseconds())
+		}
+		return err
+	}
+}
+
+// giveUp finishes jobs that failed maxJobRetries times after their first run
+// instead of retrying them forever, dropping their checkpoint
+func (r *runner) giveUp(work func(job) error) func(job) error {
+	return func(j job) error {
+		err := work(j)
+		if err == nil || j.ErrorCount < maxJobRetries {
+			return err
+		}
+		slog.Error("job given up", "job_id", j.ID, "type", j.Type, "attempts", j.ErrorCount+1, "error", firstLine(err.Error()))
+		if err := r.state.Delete(j.ID); err != nil {
+			slog.Warn("unable to delete the checkpoint of a given up job", "job_id", j.ID, "error", err)
+		}
+		return nil
+	}
+}
+
+// settle closes the cancellation request of a cleanup that will not run
+// again, e.g. because it was dropped or given up before it saw the request
+func (r *runner) settle(work func(job) error) func(job) error {
+	return func(j job) error {
+		err := work(j)
+		if err != nil {
+			return err
+		}
+		if err := r.state.stopped(j.ID, "", 0, 0); err != nil {
+			slog.Warn("unable to close the cancellation request", "job_id", j.ID, "error", err)
+		}
+		return nil
+	}
+}
+
+// enqueuer stores a job to run at runAt, a zero runAt meaning right away
+type enqueuer interface {
+	enqueue(jobType string, args []byte, runAt time.Time) error
+}
+
+// producer implements the Queue methods that build and enqueue requests on
+// top of the storage of a Queue implementation
+type producer struct {
+	enqueuer
+}
+
+func (p producer) enqueueRequest(jobType string, req interface{}, runAt time.Time) error {
+	args, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	if err := p.enqueue(jobType, args, runAt); err != nil {
+		return err
+	}
+	metrics.JobEnqueued(jobType)
+	return nil
+}
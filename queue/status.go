@@ -0,0 +1,166 @@
+package queue
+
+import (
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/metrics"
+)
+
+// maxLastErrorLength truncates job errors, which may be full stack traces
+var maxLastErrorLength = 200
+
+const sqlUserJobs = `
+WITH locks (job_id) AS (` + sqlLockedJobs + `)
+SELECT j.job_id,
+       j.job_class,
+       j.args,
+       j.run_at,
+       j.error_count,
+       coalesce(j.last_error, ''),
+       l.job_id IS NOT NULL AS running,
+       (SELECT count(*)
+        FROM que_jobs o
+        WHERE o.queue = j.queue
+          AND o.run_at <= now()
+          AND (o.priority, o.run_at, o.job_id) < (j.priority, j.run_at, j.job_id)
+          AND o.job_id NOT IN (SELECT job_id FROM locks)) + 1 AS position
+FROM que_jobs j
+LEFT JOIN locks l ON l.job_id = j.job_id
+WHERE j.job_class = ANY($1)
+  AND j.args->>'team_id' = $2
+  AND j.args->>'user_id' = $3
+ORDER BY j.priority, j.run_at, j.job_id`
+
+const sqlBacklog = `
+SELECT job_class,
+       count(*),
+       coalesce(extract(epoch FROM now() - min(run_at) FILTER (WHERE run_at <= now())), 0)::float8
+FROM que_jobs
+GROUP BY job_class`
+
+// JobStatus describes a queued or running job
+type JobStatus struct {
+	ID         int64
+	Type       string
+	Channel    string
+	Running    bool
+	EnqueuedAt time.Time
+	RunAt      time.Time
+	ErrorCount int
+	LastError  string
+	// Position is the place in line among jobs ready to run, zero when the
+	// job is running or scheduled for later
+	Position int
+	// Options is set for cleanup jobs
+	Options *CleanChannelOpts
+}
+
+// Scheduled reports whether the job waits for its run time
+func (s JobStatus) Scheduled() bool {
+	return !s.Running && s.RunAt.After(time.Now())
+}
+
+// UserJobs lists the cleanup and delayed delete jobs of a user of a
+// workspace in the order the workers will pick them up
+func (q *PGQueue) UserJobs(teamID, userID string) ([]JobStatus, error) {
+	rows, err := q.pgxpool.Query(sqlUserJobs, []string{CleanChannelJob, RetentionPolicyJob, DelayedDeleteJob}, teamID, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var jobs []JobStatus
+	for rows.Next() {
+		var s JobStatus
+		var args []byte
+		var errorCount int32
+		var position int64
+		if err := rows.Scan(&s.ID, &s.Type, &args, &s.RunAt, &errorCount, &s.LastError, &s.Running, &position); err != nil {
+			return nil, err
+		}
+		s.ErrorCount = int(errorCount)
+		if !s.Running && !s.Scheduled() {
+			s.Position = int(position)
+		}
+		s.LastError = firstLine(s.LastError)
+		if err := s.decodeArgs(args); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, s)
+	}
+	return jobs, rows.Err()
+}
+
+// Backlog counts the jobs of every type and how long the oldest due one has
+// been waiting
+func (q *PGQueue) Backlog() ([]metrics.Backlog, error) {
+	rows, err := q.pgxpool.Query(sqlBacklog)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	backlog := make(map[string]metrics.Backlog)
+	for rows.Next() {
+		var b metrics.Backlog
+		var depth int64
+		var age float64
+		if err := rows.Scan(&b.Type, &depth, &age); err != nil {
+			return nil, err
+		}
+		b.Depth = int(depth)
+		b.OldestDue = time.Duration(age * float64(time.Second))
+		backlog[b.Type] = b
+	}
+	return backlogList(backlog), rows.Err()
+}
+
+// backlogList orders the backlog by type, reporting the known types even
+// when none of their jobs is queued
+func backlogList(backlog map[string]metrics.Backlog) []metrics.Backlog {
+	list := make([]metrics.Backlog, 0, len(backlog)+len(jobTypes))
+	for _, jobType := range jobTypes {
+		b, ok := backlog[jobType]
+		if !ok {
+			b.Type = jobType
+		}
+		list = append(list, b)
+		delete(backlog, jobType)
+	}
+	for _, b := range backlog {
+		list = append(list, b)
+	}
+	return list
+}
+
+func (s *JobStatus) decodeArgs(args []byte) error {
+	switch s.Type {
+	case CleanChannelJob, RetentionPolicyJob:
+		var ccr CleanChannelRequest
+		if err := json.Unmarshal(args, &ccr); err != nil {
+			return err
+		}
+		s.Channel = ccr.Channel
+		s.EnqueuedAt = ccr.EnqueuedAt
+		s.Options = &ccr.Options
+	case DelayedDeleteJob:
+		var ddr DelayedDeleteRequest
+		if err := json.Unmarshal(args, &ddr); err != nil {
+			return err
+		}
+		s.Channel = ddr.Channel
+		s.EnqueuedAt = ddr.EnqueuedAt
+	}
+	return nil
+}
+
+// firstLine trims an error down to its first line
+func firstLine(s string) string {
+	if i := strings.IndexByte(s, '\n'); i >= 0 {
+		s = s[:i]
+	}
+	if len(s) > maxLastErrorLength {
+		s = s[:maxLastErrorLength] + "..."
+	}
+	return s
+}
@@ -0,0 +1,169 @@
+package queue
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+const (
+	// CategoryOwn marks messages posted by the requesting user
+	CategoryOwn = "own"
+	// CategoryBot marks messages posted by bots
+	CategoryBot = "bot"
+	// CategoryFile marks files shared by the requesting user
+	CategoryFile = "file"
+
+	// ConfirmCleanCallback identifies the Confirm/Cancel prompt of /clean
+	ConfirmCleanCallback = "clean_confirm"
+)
+
+// ageBucket groups matched items by how long ago they were posted
+type ageBucket struct {
+	label  string
+	maxAge time.Duration
+}
+
+var ageBuckets = []ageBucket{
+	{"last 24 hours", 24 * time.Hour},
+	{"last 7 days", 7 * 24 * time.Hour},
+	{"last 30 days", 30 * 24 * time.Hour},
+	{"last year", 365 * 24 * time.Hour},
+	{"older than a year", 0},
+}
+
+// CleanupSummary tallies the items a cleanup matched, broken down by
+// category, type and age
+type CleanupSummary struct {
+	now        time.Time
+	Replies    int
+	Categories map[string]int
+	Types      map[string]int
+	Ages       []int
+}
+
+// NewCleanupSummary creates an empty summary with ages measured from now
+func NewCleanupSummary(now time.Time) *CleanupSummary {
+	return &CleanupSummary{
+		now:        now,
+		Categories: make(map[string]int),
+		Types:      make(map[string]int),
+		Ages:       make([]int, len(ageBuckets)),
+	}
+}
+
+// AddMessage records a matched message
+func (s *CleanupSummary) AddMessage(m slack.Message, category string) {
+	msgType := m.SubType
+	if msgType == "" {
+		msgType = m.Type
+	}
+	s.Categories[category]++
+	s.Types[msgType]++
+	if isThreadReply(m) {
+		s.Replies++
+	}
+	if t, err := parseTimestamp(m.Timestamp); err == nil {
+		s.addAge(t)
+	}
+}
+
+// AddFile records a matched file
+func (s *CleanupSummary) AddFile(f slack.File) {
+	fileType := f.Filetype
+	if fileType == "" {
+		fileType = "unknown"
+	}
+	s.Categories[CategoryFile]++
+	s.Types["file ("+fileType+")"]++
+	s.addAge(f.Created.Time())
+}
+
+func (s *CleanupSummary) addAge(t time.Time) {
+	age := s.now.Sub(t)
+	for i, b := range ageBuckets {
+		if b.maxAge == 0 || age < b.maxAge {
+			s.Ages[i]++
+			return
+		}
+	}
+}
+
+// Total returns the number of matched items across all categories
+func (s *CleanupSummary) Total() int {
+	total := 0
+	for _, n := range s.Categories {
+		total += n
+	}
+	return total
+}
+
+// Message renders the summary as an ephemeral dry run report
+func (s *CleanupSummary) Message(channel string) slack.Msg {
+	lines := append([]string{fmt.Sprintf("Dry run for <#%s>: %s would be deleted.", channel, s.counts())}, s.breakdown()...)
+	return slack.Msg{
+		ResponseType: "ephemeral",
+		Text:         strings.Join(lines, "\n"),
+	}
+}
+
+// ConfirmMessage renders the summary of a previewed cleanup as a prompt to
+// confirm it. The options are held server side, the buttons only carry the
+// nonce they are stored under.
+func (s *CleanupSummary) ConfirmMessage(channel string, opts CleanChannelOpts, nonce string) slack.Msg {
+	msg := slack.Msg{
+		ResponseType:    "ephemeral",
+		ReplaceOriginal: true,
+	}
+	if s.Total() == 0 {
+		msg.Text = fmt.Sprintf("Nothing in <#%s> matches this cleanup, nothing will be deleted.", channel)
+		return msg
+	}
+	lines := []string{opts.Describe(channel), fmt.Sprintf("As of now that is %s.", s.counts())}
+	msg.Text = strings.Join(append(lines, s.breakdown()...), "\n")
+	msg.Attachments = []slack.Attachment{{
+		Fallback:   "Confirm the cleanup",
+		CallbackID: ConfirmCleanCallback,
+		Actions: []slack.AttachmentAction{
+			{Name: "confirm", Text: "Confirm", Type: "button", Style: "danger", Value: nonce},
+			{Name: "cancel", Text: "Cancel", Type: "button", Value: nonce},
+		},
+	}}
+	return msg
+}
+
+// counts spells out the matches of every category
+func (s *CleanupSummary) counts() string {
+	return fmt.Sprintf("%d of your messages, %d bot messages and %d files",
+		s.Categories[CategoryOwn], s.Categories[CategoryBot], s.Categories[CategoryFile])
+}
+
+// breakdown lists the matches by type and by age
+func (s *CleanupSummary) breakdown() []string {
+	var lines []string
+	if s.Replies > 0 {
+		lines = append(lines, fmt.Sprintf("%d of those messages are thread replies.", s.Replies))
+	}
+	if s.Total() == 0 {
+		return lines
+	}
+	types := make([]string, 0, len(s.Types))
+	for t := range s.Types {
+		types = append(types, t)
+	}
+	sort.Strings(types)
+	for i, t := range types {
+		types[i] = fmt.Sprintf("%s %d", t, s.Types[t])
+	}
+	lines = append(lines, "By type: "+strings.Join(types, ", "))
+	var ages []string
+	for i, n := range s.Ages {
+		if n > 0 {
+			ages = append(ages, fmt.Sprintf("%s %d", ageBuckets[i].label, n))
+		}
+	}
+	return append(lines, "By age: "+strings.Join(ages, ", "))
+}
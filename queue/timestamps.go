@@ -0,0 +1,31 @@
+package queue
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// parseTimestamp converts a Slack message timestamp ("1545079391.000200")
+// into a time.Time
+func parseTimestamp(ts string) (time.Time, error) {
+	parts := strings.SplitN(ts, ".", 2)
+	sec, err := strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+	var usec int64
+	if len(parts) == 2 {
+		usec, err = strconv.ParseInt(parts[1], 10, 64)
+		if err != nil {
+			return time.Time{}, err
+		}
+	}
+	return time.Unix(sec, usec*int64(time.Microsecond)), nil
+}
+
+// formatTimestamp converts a time.Time into a Slack message timestamp
+func formatTimestamp(t time.Time) string {
+	return fmt.Sprintf("%d.%06d", t.Unix(), t.Nanosecond()/int(time.Microsecond))
+}
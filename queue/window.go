@@ -0,0 +1,106 @@
+package queue
+
+import (
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/nlopes/slack"
+)
+
+// DateLayout is the layout accepted for the Since and Until options
+const DateLayout = "2006-01-02"
+
+// timeWindow bounds a cleanup to items posted within [oldest, latest).
+// A zero bound is open ended.
+type timeWindow struct {
+	oldest time.Time
+	latest time.Time
+}
+
+// hasDateFilter reports whether any of the date or age options are set
+func (o CleanChannelOpts) hasDateFilter() bool {
+	return o.OlderThanDays > 0 || o.Since != "" || o.Until != ""
+}
+
+// window resolves the date and age options into absolute bounds. Dates are
+// whole days in loc, Since and Until both inclusive.
+func (o CleanChannelOpts) window(loc *time.Location, now time.Time) (timeWindow, error) {
+	var w timeWindow
+	if o.Since != "" {
+		since, err := time.ParseInLocation(DateLayout, o.Since, loc)
+		if err != nil {
+			return w, fmt.Errorf("invalid since date %q", o.Since)
+		}
+		w.oldest = since
+	}
+	if o.Until != "" {
+		until, err := time.ParseInLocation(DateLayout, o.Until, loc)
+		if err != nil {
+			return w, fmt.Errorf("invalid until date %q", o.Until)
+		}
+		w.latest = until.AddDate(0, 0, 1)
+	}
+	if o.OlderThanDays > 0 {
+		cutoff := now.In(loc).AddDate(0, 0, -o.OlderThanDays)
+		if w.latest.IsZero() || cutoff.Before(w.latest) {
+			w.latest = cutoff
+		}
+	}
+	if !w.oldest.IsZero() && !w.latest.IsZero() && !w.oldest.Before(w.latest) {
+		return w, fmt.Errorf("empty date range")
+	}
+	return w, nil
+}
+
+// contains reports whether t falls inside the window
+func (w timeWindow) contains(t time.Time) bool {
+	if !w.oldest.IsZero() && t.Before(w.oldest) {
+		return false
+	}
+	if !w.latest.IsZero() && !t.Before(w.latest) {
+		return false
+	}
+	return true
+}
+
+// historyBounds formats the window as conversations.history oldest/latest
+func (w timeWindow) historyBounds() (oldest, latest string) {
+	if !w.oldest.IsZero() {
+		oldest = formatTimestamp(w.oldest)
+	}
+	if !w.latest.IsZero() {
+		latest = formatTimestamp(w.latest)
+	}
+	return oldest, latest
+}
+
+// fileBounds applies the window to files.list parameters
+func (w timeWindow) fileBounds(params *slack.GetFilesParameters) {
+	if !w.oldest.IsZero() {
+		params.TimestampFrom = slack.JSONTime(w.oldest.Unix())
+	}
+	if !w.latest.IsZero() {
+		params.TimestampTo = slack.JSONTime(w.latest.Unix())
+	}
+}
+
+// userLocation looks up the Slack timezone of a user, falling back to their
+// UTC offset and finally to UTC, also when the lookup itself fails
+func userLocation(api *limitedClient, userID string, logger *slog.Logger) *time.Location {
+	user, err := api.GetUserInfo(userID)
+	if err != nil {
+		logger.Warn("unable to look up the timezone of the user, using UTC", "user_id", userID, "error", err)
+		return time.UTC
+	}
+	if user.TZ != "" {
+		if loc, err := time.LoadLocation(user.TZ); err == nil {
+			return loc
+		}
+	}
+	if user.TZOffset != 0 {
+		return time.FixedZone("UTC"+strconv.Itoa(user.TZOffset/3600), user.TZOffset)
+	}
+	return time.UTC
+}
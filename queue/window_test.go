@@ -0,0 +1,77 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindow(t *testing.T) {
+	loc := time.FixedZone("UTC+2", 2*60*60)
+	day := func(d int) time.Time {
+		return time.Date(2019, time.January, d, 0, 0, 0, 0, loc)
+	}
+	now := time.Date(2019, time.February, 15, 12, 0, 0, 0, time.UTC)
+	cutoff := now.In(loc).AddDate(0, 0, -30)
+	tests := []struct {
+		name    string
+		opts    CleanChannelOpts
+		want    timeWindow
+		wantErr bool
+	}{
+		{"open", CleanChannelOpts{}, timeWindow{}, false},
+		{"since", CleanChannelOpts{Since: "2019-01-10"}, timeWindow{oldest: day(10)}, false},
+		{"until is inclusive", CleanChannelOpts{Until: "2019-01-20"}, timeWindow{latest: day(21)}, false},
+		{"since and until", CleanChannelOpts{Since: "2019-01-10", Until: "2019-01-20"}, timeWindow{oldest: day(10), latest: day(21)}, false},
+		{"single day", CleanChannelOpts{Since: "2019-01-10", Until: "2019-01-10"}, timeWindow{oldest: day(10), latest: day(11)}, false},
+		{"older than", CleanChannelOpts{OlderThanDays: 30}, timeWindow{latest: cutoff}, false},
+		{"older than before until", CleanChannelOpts{OlderThanDays: 30, Until: "2019-01-20"}, timeWindow{latest: cutoff}, false},
+		{"until before older than", CleanChannelOpts{OlderThanDays: 30, Until: "2019-01-05"}, timeWindow{latest: day(6)}, false},
+		{"since after older than", CleanChannelOpts{OlderThanDays: 30, Since: "2019-01-20"}, timeWindow{}, true},
+		{"since after until", CleanChannelOpts{Since: "2019-01-20", Until: "2019-01-10"}, timeWindow{}, true},
+		{"invalid since", CleanChannelOpts{Since: "01/10/2019"}, timeWindow{}, true},
+		{"invalid until", CleanChannelOpts{Until: "2019-02-30"}, timeWindow{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := tt.opts.window(loc, now)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("window() = %+v, want an error", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("window() error = %v", err)
+			}
+			if !got.oldest.Equal(tt.want.oldest) || !got.latest.Equal(tt.want.latest) {
+				t.Errorf("window() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestWindowContains(t *testing.T) {
+	oldest := time.Date(2019, time.January, 10, 0, 0, 0, 0, time.UTC)
+	latest := time.Date(2019, time.January, 21, 0, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		w    timeWindow
+		t    time.Time
+		want bool
+	}{
+		{"open", timeWindow{}, oldest, true},
+		{"before oldest", timeWindow{oldest: oldest}, oldest.Add(-time.Second), false},
+		{"at oldest", timeWindow{oldest: oldest}, oldest, true},
+		{"before latest", timeWindow{latest: latest}, latest.Add(-time.Second), true},
+		{"at latest", timeWindow{latest: latest}, latest, false},
+		{"inside", timeWindow{oldest: oldest, latest: latest}, oldest.AddDate(0, 0, 5), true},
+		{"after", timeWindow{oldest: oldest, latest: latest}, latest.AddDate(0, 0, 5), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.w.contains(tt.t); got != tt.want {
+				t.Errorf("contains(%v) = %v, want %v", tt.t, got, tt.want)
+			}
+		})
+	}
+}
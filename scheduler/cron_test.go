@@ -0,0 +1,78 @@
+package scheduler
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseScheduleErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"* * * *",
+		"* * * * * *",
+		"@yearly",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * 32 * *",
+		"* * * 0 *",
+		"* * * 13 *",
+		"* * * * 8",
+		"a * * * *",
+		"1-b * * * *",
+		"5-1 * * * *",
+		"*/0 * * * *",
+		"*/x * * * *",
+	}
+	for _, spec := range tests {
+		t.Run(spec, func(t *testing.T) {
+			if _, err := ParseSchedule(spec); err == nil {
+				t.Errorf("ParseSchedule(%q) succeeded, want an error", spec)
+			}
+		})
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	// 2019-01-01 is a Tuesday
+	at := func(day, hour, min int) time.Time {
+		return time.Date(2019, time.January, day, hour, min, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		spec string
+		from time.Time
+		want time.Time
+	}{
+		{"hourly", "@hourly", at(1, 10, 30), at(1, 11, 0)},
+		{"daily", "@daily", at(1, 10, 30), at(2, 0, 0)},
+		{"daily at midnight", "@daily", at(2, 0, 0), at(3, 0, 0)},
+		{"weekly", "@weekly", at(1, 10, 30), at(6, 0, 0)},
+		{"monthly", "@monthly", at(1, 10, 30), time.Date(2019, time.February, 1, 0, 0, 0, 0, time.UTC)},
+		{"shorthand with spaces", " @daily ", at(1, 10, 30), at(2, 0, 0)},
+		{"fixed time", "0 3 * * *", at(1, 2, 59), at(1, 3, 0)},
+		{"seconds are ignored", "0 3 * * *", at(1, 3, 0).Add(30 * time.Second), at(2, 3, 0)},
+		{"sunday as 0", "0 3 * * 0", at(1, 10, 30), at(6, 3, 0)},
+		{"sunday as 7", "0 3 * * 7", at(1, 10, 30), at(6, 3, 0)},
+		{"range ending in 7", "0 12 * * 5-7", at(5, 13, 0), at(6, 12, 0)},
+		{"weekday range", "30 2 * * 1-5", at(4, 3, 0), at(7, 2, 30)},
+		{"list", "0 0 1,15 * *", at(2, 0, 0), at(15, 0, 0)},
+		{"star step", "*/15 * * * *", at(1, 10, 31), at(1, 10, 45)},
+		{"range step", "0 9-17/4 * * *", at(1, 10, 30), at(1, 13, 0)},
+		{"value step", "5/20 * * * *", at(1, 10, 26), at(1, 10, 45)},
+		{"day of month or week", "0 0 13 * 5", at(1, 10, 30), at(4, 0, 0)},
+		{"leap day", "0 0 29 2 *", at(1, 0, 0), time.Date(2020, time.February, 29, 0, 0, 0, 0, time.UTC)},
+		{"never", "0 0 31 2 *", at(1, 0, 0), time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, err := ParseSchedule(tt.spec)
+			if err != nil {
+				t.Fatalf("ParseSchedule(%q): %v", tt.spec, err)
+			}
+			if got := s.Next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("Next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
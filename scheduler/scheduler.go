@@ -0,0 +1,123 @@
+package scheduler
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/king-jam/channel-cleaner/backend"
+	"github.com/king-jam/channel-cleaner/logging"
+	"github.com/king-jam/channel-cleaner/queue"
+)
+
+// DefaultSchedule is used for policies created without a schedule
+const DefaultSchedule = "@daily"
+
+// Scheduler enqueues retention policy runs when they are due. Due policies
+// are claimed with a compare and swap on their next run, so every dyno can
+// run a Scheduler without policies running twice.
+type Scheduler struct {
+	db       backend.Database
+	qc       queue.Queue
+	interval time.Duration
+	done     chan struct{}
+
+	// Archive is the archive format applied to every run, if any
+	Archive string
+}
+
+// NewScheduler creates a scheduler checking for due policies every interval
+func NewScheduler(db backend.Database, qc queue.Queue, interval time.Duration) *Scheduler {
+	return &Scheduler{
+		db:       db,
+		qc:       qc,
+		interval: interval,
+		done:     make(chan struct{}),
+	}
+}
+
+// Start runs the scheduler until Stop is called
+func (s *Scheduler) Start() {
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case now := <-ticker.C:
+			if err := s.tick(now); err != nil {
+				slog.Error("unable to schedule retention policies", "error", err)
+			}
+		}
+	}
+}
+
+// Stop ends the scheduler loop
+func (s *Scheduler) Stop() {
+	close(s.done)
+}
+
+// NextRun computes the first run of a schedule after now
+func NextRun(schedule string, now time.Time) (time.Time, error) {
+	sched, err := ParseSchedule(schedule)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return sched.Next(now.UTC()), nil
+}
+
+func (s *Scheduler) tick(now time.Time) error {
+	policies, err := s.db.GetDueRetentionPolicies(now)
+	if err != nil {
+		return err
+	}
+	for i := range policies {
+		if err := s.run(&policies[i], now); err != nil {
+			slog.Error("unable to run the retention policy", "policy_id", policies[i].ID, "error", err)
+		}
+	}
+	return nil
+}
+
+func (s *Scheduler) run(p *backend.RetentionPolicy, now time.Time) error {
+	next, err := NextRun(p.Schedule, now)
+	if err != nil {
+		return err
+	}
+	claimed, err := s.db.ClaimRetentionPolicy(p, next)
+	if err != nil || !claimed {
+		return err
+	}
+	pending, err := s.qc.PendingRetentionPolicy(p.ID)
+	if err != nil || pending {
+		return err
+	}
+	t, err := s.db.GetTokenData(p.TeamID, p.EnterpriseID, p.UserID)
+	if err == backend.ErrRecordNotFound {
+		// the token was revoked, the policy resumes if the user reinstalls
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.db.TouchTokenData(t.ID); err != nil {
+		slog.Warn("unable to record token use", "policy_id", p.ID, "error", err)
+	}
+	opts := queue.CleanChannelOpts{
+		Messages:      p.Messages,
+		Files:         p.Files,
+		Bots:          p.Bots,
+		OlderThanDays: p.OlderThanDays,
+		KeepLast:      p.KeepLast,
+		Archive:       s.Archive,
+	}
+	// every run gets its own ID to follow it from here into the job logs
+	requestID := logging.NewRequestID()
+	ctx := logging.WithRequestID(context.Background(), requestID)
+	if err := s.qc.QueueRetentionPolicy(ctx, p.ID, p.TeamID, p.EnterpriseID, p.ChannelID, p.UserID, opts); err != nil {
+		return err
+	}
+	slog.Info("retention policy enqueued", "policy_id", p.ID, "team_id", p.TeamID,
+		"channel_id", p.ChannelID, "request_id", requestID)
+	return nil
+}